@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/nathants/s4"
@@ -33,57 +37,122 @@ func Rm() {
 	panic1(s4.Rm(prefix, *recursive, servers))
 }
 
+func mapFlags(flg *flag.FlagSet) (func() s4.MapOptions, *bool) {
+	timeout := flg.Duration("timeout", 0, "kill cmd after this long, ie 2h, instead of 5m")
+	retries := flg.Int("retries", 0, "re-run a failed cmd up to N times in a fresh tempdir")
+	retryBackoff := flg.Duration("retry-backoff", time.Second, "wait before the first retry, doubling every retry")
+	keepGoing := flg.Bool("keep-going", false, "run every key even when some fail, then report every failure")
+	resume := flg.Bool("resume", false, "skip inputs whose outputs already exist with valid checksums")
+	dryRun := flg.Bool("dry-run", false, "print the inputs and outputs every server would process without running anything")
+	memory := flg.String("memory", "", "limit memory per cmd, ie 4G")
+	cpuWeight := flg.Int("cpu-weight", 0, "cgroup cpu weight per cmd, 1-10000, default 100")
+	pids := flg.Int("pids", 0, "limit processes per cmd")
+	disk := flg.String("disk", "", "limit tempdir disk usage per cmd, ie 10G")
+	logs := flg.Bool("logs", false, "stream cmd stderr lines prefixed with server and key to stderr")
+	async := flg.Bool("async", false, "submit the job, print its id, and return without waiting")
+	opts := func() s4.MapOptions {
+		opts := s4.MapOptions{Timeout: *timeout, Retries: *retries, RetryBackoff: *retryBackoff, KeepGoing: *keepGoing, Resume: *resume, DryRun: *dryRun}
+		opts.Limits = lib.Limits{
+			Memory:    panic2(lib.ParseSize(*memory)).(int64),
+			CPUWeight: *cpuWeight,
+			Pids:      *pids,
+			Disk:      panic2(lib.ParseSize(*disk)).(int64),
+		}
+		if *logs {
+			opts.Logs = printLog
+		}
+		return opts
+	}
+	return opts, async
+}
+
+func runMap(kind string, indir string, outdir string, cmd string, opts s4.MapOptions, async bool, servers []lib.Server, run func() error) {
+	if opts.DryRun {
+		printPlans(panic2(s4.Plan(kind, indir, outdir, cmd, opts, servers)).([]*lib.JobPlan))
+		return
+	}
+	if async {
+		fmt.Println(panic2(s4.Submit(kind, indir, outdir, cmd, opts, servers)).(string))
+		return
+	}
+	checkMap(run())
+}
+
 func Map() {
 	flg := flag.NewFlagSet("map", flag.ExitOnError)
 	usage := func() {
-		panic2(fmt.Fprintln(os.Stderr, "usage: s4 map INDIR OUTDIR CMD [-c]"))
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 map [flags] INDIR OUTDIR CMD [CMD...]"))
 		flg.PrintDefaults()
 		os.Exit(1)
 	}
+	opts, async := mapFlags(flg)
 	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
 	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
 		usage()
 	}
 	panic1(flg.Parse(os.Args[2:]))
-	if flg.NArg() != 3 {
+	if flg.NArg() < 3 {
 		usage()
 	}
+	for _, arg := range flg.Args()[3:] {
+		if strings.HasPrefix(arg, "-") {
+			panic2(fmt.Fprintf(os.Stderr, "flags must come before INDIR, got: %s\n", arg))
+			usage()
+		}
+	}
 	indir := flg.Arg(0)
 	outdir := flg.Arg(1)
 	cmd := flg.Arg(2)
 	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
-	panic1(s4.Map(indir, outdir, cmd, servers, func() { fmt.Printf("ok ") }))
+	mapOpts := opts()
+	mapOpts.Cmds = flg.Args()[3:]
+	runMap(lib.KindMap, indir, outdir, cmd, mapOpts, *async, servers, func() error {
+		return s4.MapWithOptions(indir, outdir, cmd, mapOpts, servers, func() { fmt.Printf("ok ") })
+	})
 }
 
 func MapToN() {
 	flg := flag.NewFlagSet("map-to-n", flag.ExitOnError)
 	usage := func() {
-		panic2(fmt.Fprintln(os.Stderr, "usage: s4 map-to-n INDIR OUTDIR CMD [-c]"))
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 map-to-n [flags] INDIR OUTDIR [CMD]"))
 		flg.PrintDefaults()
 		os.Exit(1)
 	}
+	partitionBy := flg.String("partition-by", "", "partition cmd output lines into numbered files by hashing a field, ie field:2,sep:, or the whole line")
+	partitions := flg.Int("partitions", 0, "number of partitions for -partition-by")
+	combine := flg.String("combine", "", "merge outputs for the same partition on each server with this cmd before sending them")
+	stream := flg.Bool("stream", false, "send every file as soon as cmd prints its path instead of after cmd exits")
+	opts, async := mapFlags(flg)
 	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
 	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
 		usage()
 	}
 	panic1(flg.Parse(os.Args[2:]))
-	if flg.NArg() != 3 {
+	if flg.NArg() != 3 && (*partitionBy == "" || flg.NArg() != 2) {
 		usage()
 	}
 	indir := flg.Arg(0)
 	outdir := flg.Arg(1)
 	cmd := flg.Arg(2)
 	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
-	panic1(s4.MapToN(indir, outdir, cmd, servers, func() { fmt.Printf("ok ") }))
+	mapOpts := opts()
+	mapOpts.Combine = *combine
+	mapOpts.PartitionBy = *partitionBy
+	mapOpts.Stream = *stream
+	mapOpts.Partitions = *partitions
+	runMap(lib.KindMapToN, indir, outdir, cmd, mapOpts, *async, servers, func() error {
+		return s4.MapToNWithOptions(indir, outdir, cmd, mapOpts, servers, func() { fmt.Printf("ok ") })
+	})
 }
 
 func MapFromN() {
 	flg := flag.NewFlagSet("map-from-n", flag.ExitOnError)
 	usage := func() {
-		panic2(fmt.Fprintln(os.Stderr, "usage: s4 map-from-n INDIR OUTDIR CMD [-c]"))
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 map-from-n [flags] INDIR OUTDIR CMD"))
 		flg.PrintDefaults()
 		os.Exit(1)
 	}
+	opts, async := mapFlags(flg)
 	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
 	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
 		usage()
@@ -96,7 +165,40 @@ func MapFromN() {
 		usage()
 	}
 	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
-	panic1(s4.MapFromN(indir, outdir, cmd, servers, func() { fmt.Printf("ok ") }))
+	mapOpts := opts()
+	runMap(lib.KindMapFromN, indir, outdir, cmd, mapOpts, *async, servers, func() error {
+		return s4.MapFromNWithOptions(indir, outdir, cmd, mapOpts, servers, func() { fmt.Printf("ok ") })
+	})
+}
+
+func Join() {
+	flg := flag.NewFlagSet("join", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 join [flags] INDIR_A INDIR_B OUTDIR CMD"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	how := flg.String("how", lib.JoinInner, "join partitions present in both indirs, in INDIR_A, or in either")
+	opts, async := mapFlags(flg)
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	indir := flg.Arg(0)
+	joinIndir := flg.Arg(1)
+	outdir := flg.Arg(2)
+	cmd := flg.Arg(3)
+	if flg.NArg() != 4 || !lib.Contains([]string{lib.JoinInner, lib.JoinLeft, lib.JoinOuter}, *how) {
+		usage()
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	mapOpts := opts()
+	mapOpts.JoinIndir = joinIndir
+	mapOpts.Join = *how
+	runMap(lib.KindJoin, indir, outdir, cmd, mapOpts, *async, servers, func() error {
+		return s4.Join(indir, joinIndir, outdir, cmd, *how, mapOpts, servers, func() { fmt.Printf("ok ") })
+	})
 }
 
 func Eval() {
@@ -189,29 +291,452 @@ func Cp() {
 	panic1(s4.Cp(src, dst, *recursive, servers))
 }
 
+func Where() {
+	flg := flag.NewFlagSet("where", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 where KEY... [-partitions N] [-shares] [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	partitions := flg.Int("partitions", 0, "print the server for partitions KEY/000..N-1")
+	shares := flg.Bool("shares", false, "print expected vs actual share of keys per server")
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() == 0 || (*partitions != 0 && flg.NArg() != 1) {
+		usage()
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	counts := make(map[string]int64)
+	uniform := lib.Conf.Placement == lib.PlacementModulo
+	if *partitions != 0 {
+		width := len(fmt.Sprint(*partitions - 1))
+		if width < 3 {
+			width = 3
+		}
+		for i := 0; i < *partitions; i++ {
+			partition := fmt.Sprintf("%0*d", width, i)
+			placement := panic2(lib.Where(strings.TrimSuffix(flg.Arg(0), "/")+"/"+partition, servers)).(*lib.Placement)
+			counts[placement.Servers[0].Name]++
+			uniform = uniform && placement.Numeric
+			fmt.Println(partition, serverNames(placement.Servers))
+		}
+	} else {
+		for _, key := range flg.Args() {
+			placement := panic2(lib.Where(key, servers)).(*lib.Placement)
+			method := "hashed"
+			if placement.Numeric {
+				method = "numeric"
+			}
+			counts[placement.Servers[0].Name]++
+			uniform = uniform && placement.Numeric
+			fmt.Println(placement.Key, placement.Prefix, method, placement.Value, serverNames(placement.Servers))
+		}
+	}
+	if *shares {
+		printShares(servers, counts, "keys", uniform)
+	}
+}
+
+func printShares(servers []lib.Server, actual map[string]int64, unit string, uniform bool) {
+	var totalWeight int
+	var total int64
+	for _, server := range servers {
+		totalWeight += server.Weight
+		total += actual[server.Name]
+	}
+	for _, server := range servers {
+		share := 0.0
+		if total != 0 {
+			share = float64(actual[server.Name]) / float64(total) * 100
+		}
+		expected := float64(server.Weight) / float64(totalWeight) * 100
+		if uniform {
+			expected = 100 / float64(len(servers))
+		}
+		fmt.Printf("%s weight=%d expected=%.1f%% actual=%.1f%% %s=%d\n", server.Name, server.Weight, expected, share, unit, actual[server.Name])
+	}
+}
+
+func Du() {
+	flg := flag.NewFlagSet("du", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 du [PREFIX] [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() > 1 {
+		usage()
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	usages := panic2(s4.Du(flg.Arg(0), servers)).([]s4.Usage)
+	bytes := make(map[string]int64)
+	for _, usage := range usages {
+		bytes[usage.Server.Name] = usage.Bytes
+	}
+	printShares(servers, bytes, "bytes", false)
+}
+
+func serverNames(servers []lib.Server) string {
+	var names []string
+	for _, server := range servers {
+		names = append(names, server.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func Rebalance() {
+	flg := flag.NewFlagSet("rebalance", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 rebalance [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() != 0 {
+		usage()
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	sent, err := s4.Rebalance(servers, func() { fmt.Printf("ok ") })
+	panic1(err)
+	fmt.Printf("\nsent %d keys\n", sent)
+}
+
+func printPlans(plans []*lib.JobPlan) {
+	for _, plan := range plans {
+		for _, task := range plan.Tasks {
+			fields := []string{plan.Server}
+			if task.Group != "" {
+				fields = append(fields, "group="+task.Group)
+			}
+			fields = append(fields, task.Inputs...)
+			fields = append(fields, "->", task.Outputs)
+			fmt.Println(strings.Join(fields, " "))
+		}
+		for _, key := range plan.Skipped {
+			fmt.Println(plan.Server, "skipped", key)
+		}
+	}
+}
+
+func checkMap(err error) {
+	var mapErr *s4.MapError
+	if errors.As(err, &mapErr) {
+		fmt.Println()
+		tw := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+		panic2(fmt.Fprintln(tw, "server\tkey\texit\tstderr"))
+		for _, failure := range mapErr.Failures {
+			panic2(fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", failure.Server, failure.Key, failure.Exit(), failure.LastLine()))
+		}
+		panic1(tw.Flush())
+		panic2(fmt.Fprintf(os.Stderr, "%d keys failed\n", len(mapErr.Failures)))
+		os.Exit(1)
+	}
+	panic1(err)
+}
+
+func printStatus(status *lib.JobStatus, durations bool) {
+	counts := make(map[string]int)
+	for _, ks := range status.Keys {
+		counts[ks.Status]++
+	}
+	end := status.End
+	if end.IsZero() {
+		end = time.Now()
+	}
+	fmt.Printf("%s %s %s pending=%d running=%d done=%d failed=%d skipped=%d %.1fs\n", status.Server, status.Kind, status.Status,
+		counts[lib.KeyPending], counts[lib.KeyRunning], counts[lib.KeyDone], counts[lib.KeyFailed], counts[lib.KeySkipped], end.Sub(status.Start).Seconds())
+	var keys []string
+	for key := range status.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ks := status.Keys[key]
+		fields := []string{" ", ks.Status, key}
+		if durations && !ks.Start.IsZero() {
+			keyEnd := ks.End
+			if keyEnd.IsZero() {
+				keyEnd = end
+			}
+			fields = append(fields, fmt.Sprintf("%.1fs", keyEnd.Sub(ks.Start).Seconds()))
+		}
+		if ks.Attempts > 1 {
+			fields = append(fields, fmt.Sprintf("attempts=%d", ks.Attempts))
+		}
+		if ks.Status == lib.KeyFailed && ks.ExitCode != nil {
+			fields = append(fields, fmt.Sprintf("exit=%d", *ks.ExitCode))
+		}
+		if ks.Error != "" {
+			fields = append(fields, lib.Tail(strings.TrimSpace(ks.Error), 1))
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+	if status.Error != "" {
+		fmt.Println(" ", "error:", strings.TrimSpace(status.Error))
+	}
+}
+
+func jobCmd(args lib.MapArgs) string {
+	return strings.Join(append([]string{args.Cmd}, args.Cmds...), " | ")
+}
+
+func jobIndir(args lib.MapArgs) string {
+	if args.JoinIndir != "" {
+		return args.Indir + "," + args.JoinIndir
+	}
+	return args.Indir
+}
+
+func requesterHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func parseSince(val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+	duration, err := time.ParseDuration(val)
+	if err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339, val)
+}
+
+func printLog(server lib.Server, line lib.JobLogLine) {
+	panic2(fmt.Fprintln(os.Stderr, server.Name, line.Key, line.Line))
+}
+
+func Job() {
+	flg := flag.NewFlagSet("job", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 job {status,wait,logs,show} ID [-f] [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	follow := flg.Bool("f", false, "with logs, keep printing new lines until the job finishes")
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() != 2 {
+		usage()
+	}
+	id := flg.Arg(1)
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	switch flg.Arg(0) {
+	case "status":
+		statuses, err := s4.GetJob(id, servers)
+		unreachable := partial(err)
+		for _, status := range statuses {
+			if status != nil {
+				printStatus(status, false)
+			}
+		}
+		printUnreachable(unreachable)
+	case "show":
+		statuses, err := s4.Journal(time.Time{}, id, servers)
+		unreachable := partial(err)
+		if len(statuses) == 0 && unreachable != nil {
+			panic1(fmt.Errorf("no such job in journal: %s, %s", id, unreachable))
+		}
+		if len(statuses) == 0 {
+			panic1(fmt.Errorf("no such job in journal: %s", id))
+		}
+		first := statuses[0]
+		fmt.Println("id", first.ID)
+		fmt.Println("kind", first.Kind)
+		fmt.Println("requester", requesterHost(first.Requester))
+		fmt.Println("indir", jobIndir(first.Args))
+		fmt.Println("outdir", first.Args.Outdir)
+		fmt.Println("cmd", jobCmd(first.Args))
+		sort.Slice(statuses, func(i, j int) bool { return statuses[i].Server < statuses[j].Server })
+		for _, status := range statuses {
+			printStatus(status, true)
+		}
+		printUnreachable(unreachable)
+	case "wait":
+		checkMap(s4.WaitJob(id, servers, func() { fmt.Printf("ok ") }))
+	case "logs":
+		panic1(s4.TailLogs(id, servers, *follow, nil, printLog))
+	default:
+		usage()
+	}
+}
+
+func partial(err error) *s4.UnreachableError {
+	var unreachable *s4.UnreachableError
+	if err != nil && !errors.As(err, &unreachable) {
+		panic1(err)
+	}
+	return unreachable
+}
+
+func printUnreachable(unreachable *s4.UnreachableError) {
+	if unreachable == nil {
+		return
+	}
+	for _, server := range unreachable.Servers {
+		panic2(fmt.Fprintln(os.Stderr, "unreachable:", server))
+	}
+	os.Exit(1)
+}
+
+func Jobs() {
+	flg := flag.NewFlagSet("jobs", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 jobs [-since DURATION|RFC3339] [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	since := flg.String("since", "24h", "list jobs started within this duration or after this time, empty for all")
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() != 0 {
+		usage()
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	statuses, err := s4.Journal(panic2(parseSince(*since)).(time.Time), "", servers)
+	unreachable := partial(err)
+	type summary struct {
+		first  *lib.JobStatus
+		status string
+		start  time.Time
+		end    time.Time
+		counts map[string]int
+	}
+	rank := map[string]int{lib.JobSucceeded: 0, lib.JobRunning: 1, lib.JobCancelled: 2, lib.JobInterrupted: 3, lib.JobFailed: 4}
+	var order []string
+	summaries := make(map[string]*summary)
+	for _, status := range statuses {
+		sum, ok := summaries[status.ID]
+		if !ok {
+			sum = &summary{first: status, status: status.Status, start: status.Start, end: status.End, counts: make(map[string]int)}
+			summaries[status.ID] = sum
+			order = append(order, status.ID)
+		}
+		if rank[status.Status] > rank[sum.status] {
+			sum.status = status.Status
+		}
+		if status.Start.Before(sum.start) {
+			sum.start = status.Start
+		}
+		if status.End.IsZero() || (!sum.end.IsZero() && status.End.After(sum.end)) {
+			sum.end = status.End
+		}
+		for _, ks := range status.Keys {
+			sum.counts[ks.Status]++
+		}
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	panic2(fmt.Fprintln(tw, "start\tid\tkind\tstatus\tduration\tkeys\tfailed\trequester\tindir\toutdir\tcmd"))
+	for _, id := range order {
+		sum := summaries[id]
+		keys := 0
+		for _, n := range sum.counts {
+			keys += n
+		}
+		duration := "-"
+		if !sum.end.IsZero() {
+			duration = fmt.Sprintf("%.1fs", sum.end.Sub(sum.start).Seconds())
+		}
+		panic2(fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", sum.start.Local().Format(time.RFC3339), id, sum.first.Kind, sum.status,
+			duration, keys, sum.counts[lib.KeyFailed], requesterHost(sum.first.Requester), jobIndir(sum.first.Args), sum.first.Args.Outdir, jobCmd(sum.first.Args)))
+	}
+	panic1(tw.Flush())
+	printUnreachable(unreachable)
+}
+
+func Cancel() {
+	flg := flag.NewFlagSet("cancel", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 cancel ID [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() != 1 {
+		usage()
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	panic1(s4.Cancel(flg.Arg(0), servers))
+}
+
+func Run() {
+	flg := flag.NewFlagSet("run", flag.ExitOnError)
+	usage := func() {
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 run PIPELINE [-state PATH] [-c]"))
+		flg.PrintDefaults()
+		os.Exit(1)
+	}
+	statePath := flg.String("state", "", "file recording completed stages for restarts, default PIPELINE.state")
+	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
+	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
+		usage()
+	}
+	panic1(flg.Parse(os.Args[2:]))
+	if flg.NArg() != 1 {
+		usage()
+	}
+	if *statePath == "" {
+		*statePath = flg.Arg(0) + ".state"
+	}
+	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
+	pipeline := panic2(s4.LoadPipeline(flg.Arg(0))).(*s4.Pipeline)
+	checkMap(s4.RunPipeline(pipeline, *statePath, os.Stdout, servers, func(stage string, status string) {
+		panic2(fmt.Fprintln(os.Stderr, "stage", stage, status))
+	}))
+}
+
 func Health() {
 	flg := flag.NewFlagSet("health", flag.ExitOnError)
 	confPath := flg.String("c", lib.DefaultConfPath(), "conf-path")
 	if lib.Contains(os.Args, "-h") || lib.Contains(os.Args, "--help") {
-		panic2(fmt.Fprintln(os.Stderr, "usage: s4 health [-r] [-c]"))
+		panic2(fmt.Fprintln(os.Stderr, "usage: s4 health [-c]"))
 		flg.PrintDefaults()
 		os.Exit(1)
 	}
+	panic1(flg.Parse(os.Args[2:]))
 	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
 	results := make(chan string, len(servers))
 	client := http.Client{Timeout: 1 * time.Second}
 	for _, server := range servers {
 		go func(server lib.Server) {
 			// defer func() {}()
-			url := fmt.Sprintf("http://%s:%s/health", server.Address, server.Port)
+			url := fmt.Sprintf("http://%s/health", server.HostPort())
 			resp, err := client.Get(url)
-			if err != nil {
-				panic1(resp.Body.Close())
+			if err == nil {
+				_ = resp.Body.Close()
 			}
 			if err != nil || resp.StatusCode != 200 {
-				results <- fmt.Sprintf("unhealthy: %s:%s", server.Address, server.Port)
+				results <- fmt.Sprintf("unhealthy: %s", server.HostPort())
+			} else if resp.Header.Get(lib.ConfHashHeader) != lib.Conf.Hash {
+				results <- fmt.Sprintf("conf mismatch: %s", server.HostPort())
 			} else {
-				results <- fmt.Sprintf("healthy:   %s:%s", server.Address, server.Port)
+				results <- fmt.Sprintf("healthy:   %s", server.HostPort())
 			}
 		}(server)
 	}
@@ -229,7 +754,7 @@ func Health() {
 }
 
 func Usage() {
-	panic2(fmt.Println(`usage: s4 {rm,eval,ls,cp,map,map-to-n,map-from-n,health}
+	panic2(fmt.Println(`usage: s4 {rm,eval,ls,cp,map,map-to-n,map-from-n,join,run,where,du,rebalance,job,jobs,cancel,health}
 
     rm                  delete data from s4
     eval                eval a bash cmd with key data as stdin
@@ -238,6 +763,14 @@ func Usage() {
     map                 process data
     map-to-n            shuffle data
     map-from-n          merge shuffled data
+    join                merge shuffled data from two dirs
+    run                 run a multi-stage pipeline
+    where               explain key placement
+    du                  disk usage per server
+    rebalance           move keys to the servers the conf places them on
+    job                 status, logs of, wait for, or show the journal of a map job
+    jobs                list past map jobs from the journal
+    cancel              cancel an async map job
     health              health check every server`))
 	os.Exit(1)
 }
@@ -255,12 +788,28 @@ func main() {
 		MapToN()
 	case "map-from-n":
 		MapFromN()
+	case "join":
+		Join()
+	case "run":
+		Run()
 	case "eval":
 		Eval()
 	case "ls":
 		Ls()
 	case "cp":
 		Cp()
+	case "where":
+		Where()
+	case "du":
+		Du()
+	case "rebalance":
+		Rebalance()
+	case "job":
+		Job()
+	case "jobs":
+		Jobs()
+	case "cancel":
+		Cancel()
 	case "health":
 		Health()
 	default:
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,10 +14,13 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cespare/xxhash"
 	"github.com/gofrs/uuid"
 	"github.com/nathants/s4"
 	"github.com/nathants/s4/lib"
@@ -22,12 +28,15 @@ import (
 )
 
 var (
-	ioJobs     = &sync.Map{}
-	ioSendPool *semaphore.Weighted
-	ioRecvPool *semaphore.Weighted
-	cpuPool    *semaphore.Weighted
-	miscPool   *semaphore.Weighted
-	soloPool   *semaphore.Weighted
+	ioJobs       = &sync.Map{}
+	mapJobs      = &sync.Map{}
+	jobRetention time.Duration
+	maxTimeout   time.Duration
+	ioSendPool   *semaphore.Weighted
+	ioRecvPool   *semaphore.Weighted
+	cpuPool      *semaphore.Weighted
+	miscPool     *semaphore.Weighted
+	soloPool     *semaphore.Weighted
 )
 
 type GetJob struct {
@@ -41,8 +50,8 @@ func prepareGetHandler(w http.ResponseWriter, r *http.Request, this lib.Server,
 	port := lib.QueryParam(r, "port")
 	key := lib.QueryParam(r, "key")
 	assert(panic2(lib.OnThisServer(key, this, servers)).(bool), "wrong server for request\n")
-	remote := strings.SplitN(r.RemoteAddr, ":", 2)[0]
-	if remote == "127.0.0.1" {
+	remote := lib.RemoteHost(r)
+	if remote == "127.0.0.1" || remote == "::1" {
 		remote = "0.0.0.0"
 	}
 	path := strings.SplitN(key, "s4://", 2)[1]
@@ -78,7 +87,7 @@ func prepareGetHandler(w http.ResponseWriter, r *http.Request, this lib.Server,
 		diskChecksum,
 	}
 	_, loaded := ioJobs.LoadOrStore(uid, job)
-	assert(!loaded, uid)
+	assert(!loaded, "%s", uid)
 	select {
 	case <-time.After(lib.Timeout):
 		ioJobs.Delete(uid)
@@ -92,7 +101,7 @@ func confirmGetHandler(w http.ResponseWriter, r *http.Request) {
 	uid := lib.QueryParam(r, "uuid")
 	clientChecksum := lib.QueryParam(r, "checksum")
 	v, ok := ioJobs.LoadAndDelete(uid)
-	assert(ok, uid)
+	assert(ok, "%s", uid)
 	job := v.(*GetJob)
 	panic1(<-job.fail)
 	serverChecksum := <-job.serverChecksum
@@ -114,7 +123,7 @@ func preparePutHandler(w http.ResponseWriter, r *http.Request, this lib.Server,
 	assert(!strings.Contains(key, " "), "key contains spaces: %s\n", key)
 	assert(panic2(lib.OnThisServer(key, this, servers)).(bool), "wrong server for request")
 	path := strings.SplitN(key, "s4://", 2)[1]
-	assert(!strings.HasPrefix(path, "_"), path)
+	assert(!strings.HasPrefix(path, "_"), "%s", path)
 	var exists bool
 	var tempPath string
 	lib.With(soloPool, func() {
@@ -139,7 +148,7 @@ func preparePutHandler(w http.ResponseWriter, r *http.Request, this lib.Server,
 	})
 	job := &PutJob{time.Now(), serverChecksum, fail, path, tempPath}
 	_, loaded := ioJobs.LoadOrStore(uid, job)
-	assert(!loaded, uid)
+	assert(!loaded, "%s", uid)
 	select {
 	case <-time.After(lib.Timeout):
 		ioJobs.Delete(uid)
@@ -181,213 +190,1144 @@ func confirmPutHandler(w http.ResponseWriter, r *http.Request) {
 func deleteHandler(r *http.Request, this lib.Server, servers []lib.Server) {
 	prefix := lib.QueryParam(r, "prefix")
 	recursive := lib.QueryParamDefault(r, "recursive", "false") == "true"
+	missingOk := lib.QueryParamDefault(r, "missing_ok", "false") == "true"
 	if !recursive {
 		assert(panic2(lib.OnThisServer(prefix, this, servers)).(bool), "wrong server for request")
 	}
 	prefix = strings.SplitN(prefix, "s4://", 2)[1]
-	assert(!strings.HasPrefix(prefix, "/"), prefix)
+	assert(!strings.HasPrefix(prefix, "/"), "%s", prefix)
 	cwd := path.Base(panic2(os.Getwd()).(string))
-	assert(cwd == "s4_data", cwd)
+	assert(cwd == "s4_data", "%s", cwd)
 	lib.With(soloPool, func() {
 		if recursive {
 			files, dirs := listRecursive(prefix, false)
 			for _, info := range *files {
-				assert(!strings.HasPrefix(info.Path, "/"), info.Path)
+				assert(!strings.HasPrefix(info.Path, "/"), "%s", info.Path)
 				panic1(os.Remove(info.Path))
 				panic1(os.Remove(panic2(lib.ChecksumPath(info.Path)).(string)))
 			}
 			for _, info := range *dirs {
-				assert(!strings.HasPrefix(info.Path, "/"), info.Path)
+				assert(!strings.HasPrefix(info.Path, "/"), "%s", info.Path)
 				panic1(os.RemoveAll(info.Path))
 			}
 		} else {
-			assert(!strings.HasPrefix(prefix, "/"), prefix)
-			panic1(os.Remove(prefix))
+			assert(!strings.HasPrefix(prefix, "/"), "%s", prefix)
+			err := os.Remove(prefix)
+			if missingOk && errors.Is(err, os.ErrNotExist) {
+				return
+			}
+			panic1(err)
 			panic1(os.Remove(panic2(lib.ChecksumPath(prefix)).(string)))
 		}
 	})
 }
 
-type MapResult struct {
-	WarnResult *lib.WarnResultTempdir
-	Outkey     string
+func localPut(tempPath string, key string, this lib.Server, servers []lib.Server) error {
+	if strings.Contains(key, " ") {
+		return fmt.Errorf("key contains space: %s", key)
+	}
+	onThisServer, err := lib.OnThisServer(key, this, servers)
+	if err != nil {
+		return err
+	}
+	if !onThisServer {
+		return fmt.Errorf("wrong server for key: %s", key)
+	}
+	path := strings.SplitN(key, "s4://", 2)[1]
+	if strings.HasPrefix(path, "_") {
+		return fmt.Errorf("path cannot start with underscore: %s", path)
+	}
+	var checksum string
+	lib.With(miscPool, func() {
+		checksum, err = lib.Checksum(tempPath)
+	})
+	if err != nil {
+		return err
+	}
+	lib.With(soloPool, func() {
+		err = confirmLocalPut(tempPath, path, checksum)
+	})
+	return err
+}
+
+func confirmLocalPut(tempPath string, path string, checksum string) error {
+	err := os.MkdirAll(lib.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	exists, err := lib.Exists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("fatal: key already exists s4://%s", path)
+	}
+	err = os.Chmod(tempPath, 0o444)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return err
+	}
+	return lib.ChecksumWrite(path, checksum)
+}
+
+func serverPut(tempPath string, key string, this lib.Server, servers []lib.Server, down []int) error {
+	replicas, err := lib.PickServers(key, servers)
+	if err != nil {
+		return err
+	}
+	for _, i := range down {
+		for _, server := range replicas {
+			if server == servers[i] {
+				return fmt.Errorf("replica %s is down, writes need every replica: %s", server.Name, key)
+			}
+		}
+	}
+	local := false
+	for _, server := range replicas {
+		if server == this {
+			local = true
+			continue
+		}
+		var conflict error
+		err := lib.Retry(func() error {
+			var err error
+			lib.With(ioSendPool, func() {
+				err = s4.PutFileTo(tempPath, key, server)
+			})
+			if errors.Is(err, s4.Err409) {
+				conflict = err
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if conflict != nil {
+			return conflict
+		}
+	}
+	if local {
+		return localPut(tempPath, key, this, servers)
+	}
+	return nil
+}
+
+var (
+	errTimeout    = errors.New("timeout")
+	errKeysFailed = errors.New("keys failed")
+)
+
+const (
+	maxJobLogLines  = 10000
+	maxLogLineSize  = 64 * 1024
+	maxRetries      = 100
+	maxPartitions   = 65536
+	stderrTailSize  = 10
+	maxResumeChecks = 64
+	resumeDir       = "_resume"
+	resumeRetention = 7 * 24 * time.Hour
+	journalPath     = "_jobs/journal.jsonl"
+)
+
+var journalMutex sync.Mutex
+
+type Job struct {
+	mutex     sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	id        string
+	kind      string
+	requester string
+	args      lib.MapArgs
+	start     time.Time
+	end       time.Time
+	status    string
+	err       error
+	keys      map[string]*lib.KeyStatus
+	logs      []lib.JobLogLine
+	logsAt    int
+	staged    []stagedOutput
+	dirs      []string
+}
+
+type stagedOutput struct {
+	inkey  string
+	outkey string
+	path   string
+}
+
+type Task struct {
+	Key    string
+	Cmd    string
+	Stdin  string
+	Outkey string
+	Outdir string
+	Group  string
+	Inputs []string
+	Files  map[string]string
+	Staged []string
+}
+
+func newJob(ctx context.Context, id string, kind string, requester string, args lib.MapArgs, tasks []*Task, skipped []string) *Job {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &Job{
+		ctx:       ctx,
+		cancel:    cancel,
+		id:        id,
+		kind:      kind,
+		requester: requester,
+		args:      args,
+		start:     time.Now(),
+		status:    lib.JobRunning,
+		keys:      make(map[string]*lib.KeyStatus),
+	}
+	for _, task := range tasks {
+		job.keys[task.Key] = &lib.KeyStatus{Status: lib.KeyPending}
+	}
+	for _, key := range skipped {
+		job.keys[key] = &lib.KeyStatus{Status: lib.KeySkipped}
+	}
+	_, loaded := mapJobs.LoadOrStore(id, job)
+	assert(!loaded, "job already exists: %s", id)
+	return job
+}
+
+func (job *Job) keyStatus(key string, status string, err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	ks := job.keys[key]
+	ks.Status = status
+	switch status {
+	case lib.KeyRunning:
+		ks.Attempts++
+		ks.Error = ""
+		if ks.Attempts == 1 {
+			ks.Start = time.Now()
+		}
+	case lib.KeyDone, lib.KeyFailed:
+		ks.End = time.Now()
+	}
+	if err != nil {
+		ks.Error = err.Error()
+	}
+}
+
+func (job *Job) keyFailed(key string, result *lib.WarnResultTempdir, err error) {
+	job.keyStatus(key, lib.KeyFailed, err)
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if result.Err == nil {
+		return
+	}
+	ks := job.keys[key]
+	exitCode := lib.ExitCode(result.Err)
+	ks.ExitCode = &exitCode
+	ks.StderrTail = lib.Tail(result.Stderr, stderrTailSize)
+}
+
+func (job *Job) log(key string, line string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if len(job.logs) == maxJobLogLines {
+		job.logs = job.logs[maxJobLogLines/2:]
+		job.logsAt += maxJobLogLines / 2
+	}
+	job.logs = append(job.logs, lib.JobLogLine{Key: key, Line: line})
+}
+
+func (job *Job) logsSince(since int) *lib.JobLogs {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if since < job.logsAt {
+		since = job.logsAt
+	}
+	end := job.logsAt + len(job.logs)
+	if since > end {
+		since = end
+	}
+	lines := make([]lib.JobLogLine, end-since)
+	copy(lines, job.logs[since-job.logsAt:])
+	return &lib.JobLogs{Lines: lines, Next: end, Done: job.status != lib.JobRunning}
 }
 
-func mapHandler(w http.ResponseWriter, r *http.Request, this lib.Server, servers []lib.Server) {
+type logWriter struct {
+	job  *Job
+	key  string
+	rest []byte
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.rest = append(lw.rest, p...)
+	for {
+		i := bytes.IndexByte(lw.rest, '\n')
+		if i == -1 {
+			break
+		}
+		lw.job.log(lw.key, string(lw.rest[:i]))
+		lw.rest = lw.rest[i+1:]
+	}
+	for len(lw.rest) >= maxLogLineSize {
+		lw.job.log(lw.key, string(lw.rest[:maxLogLineSize]))
+		lw.rest = lw.rest[maxLogLineSize:]
+	}
+	return len(p), nil
+}
+
+func (lw *logWriter) flush() {
+	if len(lw.rest) > 0 {
+		lw.job.log(lw.key, string(lw.rest))
+		lw.rest = nil
+	}
+}
+
+func (job *Job) finish(err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.end = time.Now()
+	job.err = err
+	switch {
+	case errors.Is(err, context.Canceled):
+		job.status = lib.JobCancelled
+	case err != nil:
+		job.status = lib.JobFailed
+	default:
+		job.status = lib.JobSucceeded
+	}
+}
+
+func (job *Job) report(this lib.Server) *lib.JobStatus {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	status := &lib.JobStatus{
+		ID:        job.id,
+		Kind:      job.kind,
+		Server:    this.Name,
+		Requester: job.requester,
+		Args:      job.args,
+		Status:    job.status,
+		Start:     job.start,
+		End:       job.end,
+		Keys:      make(map[string]*lib.KeyStatus),
+	}
+	if job.err != nil {
+		status.Error = job.err.Error()
+	}
+	for key, ks := range job.keys {
+		val := *ks
+		status.Keys[key] = &val
+	}
+	return status
+}
+
+func appendJournal(status *lib.JobStatus) {
+	bytes, err := json.Marshal(status)
+	if err != nil {
+		lib.Logger.Printf("journal marshal failed for job %s: %s\n", status.ID, err)
+		return
+	}
+	journalMutex.Lock()
+	defer journalMutex.Unlock()
+	f, err := os.OpenFile(journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		lib.Logger.Printf("journal open failed for job %s: %s\n", status.ID, err)
+		return
+	}
+	_, err = f.Write(append(bytes, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		lib.Logger.Printf("journal write failed for job %s: %s\n", status.ID, err)
+	}
+}
+
+func readJournal(since time.Time, id string) ([]*lib.JobStatus, error) {
+	f, err := os.Open(journalPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*lib.JobStatus{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+	statuses := []*lib.JobStatus{}
+	latest := make(map[string]int)
+	reader := bufio.NewReader(f)
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var status lib.JobStatus
+		err = json.Unmarshal(line, &status)
+		if err != nil {
+			lib.Logger.Printf("skipping bad journal line %d: %s\n", lineNum, err)
+			continue
+		}
+		if id != "" && status.ID != id {
+			continue
+		}
+		if status.Start.Before(since) {
+			continue
+		}
+		if status.Status == lib.JobRunning {
+			if _, ok := mapJobs.Load(status.ID); !ok {
+				status.Status = lib.JobInterrupted
+			}
+		}
+		if i, ok := latest[status.ID]; ok {
+			statuses[i] = &status
+			continue
+		}
+		latest[status.ID] = len(statuses)
+		statuses = append(statuses, &status)
+	}
+	return statuses, nil
+}
+
+func repairJournal() {
+	f, err := os.OpenFile(journalPath, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	panic1(err)
+	defer func() { _ = f.Close() }()
+	info := panic2(f.Stat()).(os.FileInfo)
+	if info.Size() == 0 {
+		return
+	}
+	last := make([]byte, 1)
+	_ = panic2(f.ReadAt(last, info.Size()-1))
+	if last[0] != '\n' {
+		lib.Logger.Printf("terminating torn last line of %s\n", journalPath)
+		_ = panic2(f.WriteAt([]byte("\n"), info.Size()))
+	}
+}
+
+func parseMapArgs(r *http.Request) (string, lib.MapArgs) {
 	var data lib.MapArgs
 	defer func() { _ = r.Body.Close() }()
 	bytes := panic2(io.ReadAll(r.Body)).([]byte)
 	panic1(json.Unmarshal(bytes, &data))
-	indir, glob := lib.ParseGlob(data.Indir)
-	outdir := data.Outdir
-	assert(strings.HasSuffix(indir, "/"), fmt.Sprintf("indir not a directory: %s", indir))
-	assert(strings.HasSuffix(outdir, "/"), fmt.Sprintf("outdir not a directory: %s", outdir))
-	pth := strings.SplitN(indir, "://", 2)[1]
-	files, _ := listRecursive(pth, true)
-	pth = strings.SplitN(pth, "/", 2)[1]
+	if data.Timeout == 0 {
+		data.Timeout = lib.Timeout
+	}
+	assert(data.Timeout >= 0, "timeout must not be negative, got: %s", data.Timeout)
+	assert(data.Timeout <= maxTimeout, "timeout %s exceeds server max-timeout %s", data.Timeout, maxTimeout)
+	assert(data.Retries >= 0 && data.Retries <= maxRetries, "retries must be between 0 and %d, got: %d", maxRetries, data.Retries)
+	assert(data.Combine == "" || !data.Resume, "resume is not supported with combine")
+	assert(!data.Stream || (data.Retries == 0 && data.Combine == "" && data.PartitionBy == ""), "stream is not supported with retries, combine, or partition-by")
+	if data.PartitionBy != "" {
+		_ = panic2(lib.ParsePartitionBy(data.PartitionBy, data.Partitions))
+		assert(data.Partitions <= maxPartitions, "partitions must be at most %d, got: %d", maxPartitions, data.Partitions)
+	}
+	id := lib.QueryParamDefault(r, "id", uuid.Must(uuid.NewV4()).String())
+	return id, data
+}
+
+func planJob(kind string, data lib.MapArgs, this lib.Server, servers []lib.Server) ([]*Task, []string) {
 	if strings.HasPrefix(data.Cmd, "while read") {
 		data.Cmd = fmt.Sprintf("cat | %s", data.Cmd)
 	}
-	results := make(chan MapResult, len(*files))
-	count := 0
-	for _, file := range *files {
-		size := file.Size
-		key := file.Path
-		if pth != "" {
-			key = strings.SplitN(key, pth, 2)[1]
-		}
-		if size == "PRE" {
-			continue
+	assert(len(data.Cmds) == 0 || kind == lib.KindMap, "multiple cmds are only supported by map")
+	var tasks []*Task
+	switch kind {
+	case lib.KindMap:
+		tasks = planMap(data, this, servers)
+	case lib.KindMapToN:
+		tasks = planMapToN(data, this, servers)
+	case lib.KindMapFromN:
+		tasks = planMapFromN(data, this, servers)
+	case lib.KindJoin:
+		tasks = planJoin(data, this, servers)
+	default:
+		panic(fmt.Sprintf("unknown job kind: %s", kind))
+	}
+	if !data.Resume {
+		return tasks, nil
+	}
+	return resumeTasks(tasks, data, this, servers)
+}
+
+func verifyLocal(path string) (bool, error) {
+	exists, err := lib.Exists(path)
+	if err != nil || !exists {
+		return false, err
+	}
+	diskChecksum, err := lib.ChecksumRead(path)
+	if err != nil {
+		return false, err
+	}
+	var checksum string
+	lib.With(miscPool, func() {
+		checksum, err = lib.Checksum(path)
+	})
+	if err != nil {
+		return false, err
+	}
+	return checksum == diskChecksum, nil
+}
+
+func outputValid(key string, this lib.Server, servers []lib.Server, down []int) (bool, error) {
+	primary, err := lib.PickPrimary(key, servers, down)
+	if err != nil {
+		return false, err
+	}
+	if primary == this {
+		return verifyLocal(strings.SplitN(key, "s4://", 2)[1])
+	}
+	result := lib.Get(fmt.Sprintf("http://%s/checksum?key=%s&verify=true", primary.HostPort(), key))
+	if result.Err != nil {
+		return false, result.Err
+	}
+	return result.StatusCode == 200, nil
+}
+
+func resumeMarker(task *Task, data lib.MapArgs) string {
+	fields := []string{task.Key, task.Outdir, task.Cmd, data.PartitionBy, fmt.Sprint(data.Partitions)}
+	return lib.Join(resumeDir, fmt.Sprintf("%016x", xxhash.Sum64String(strings.Join(fields, "\x00"))))
+}
+
+func writeResumeMarker(task *Task, data lib.MapArgs, outkeys []string) error {
+	return os.WriteFile(resumeMarker(task, data), []byte(strings.Join(outkeys, "\n")), 0o644)
+}
+
+func removeOutputs(task *Task, down []int, servers []lib.Server) error {
+	var targets []lib.Server
+	query := fmt.Sprintf("prefix=%s&missing_ok=true", task.Outkey)
+	if task.Outkey != "" {
+		live, err := lib.PickLive(task.Outkey, servers, down)
+		if err != nil {
+			return err
 		}
-		if glob != "" {
-			match := panic2(path.Match(glob, key)).(bool)
-			fmt.Println(match, glob, key)
-			if !match {
-				continue
+		targets = live
+	} else {
+		query = fmt.Sprintf("prefix=%s/&recursive=true", task.Outdir)
+		for i, server := range servers {
+			if !lib.ContainsInt(down, i) {
+				targets = append(targets, server)
 			}
 		}
-		inkey := lib.Join(indir, key)
-		outkey := lib.Join(outdir, key)
-		inpath := panic2(filepath.Abs(strings.SplitN(inkey, "s4://", 2)[1])).(string)
-		go func(inpath string) {
+	}
+	for _, server := range targets {
+		result := lib.Post(fmt.Sprintf("http://%s/delete?%s", server.HostPort(), query), "application/text", bytes.NewBuffer([]byte{}))
+		if result.Err != nil {
+			return result.Err
+		}
+		if result.StatusCode != 200 {
+			return fmt.Errorf("remove outputs of %s: %d %s", task.Key, result.StatusCode, result.Body)
+		}
+	}
+	return nil
+}
+
+func taskDone(task *Task, data lib.MapArgs, this lib.Server, servers []lib.Server) (bool, error) {
+	outkeys := []string{task.Outkey}
+	if task.Outkey == "" {
+		bytes, err := os.ReadFile(resumeMarker(task, data))
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		outkeys = strings.Fields(string(bytes))
+	}
+	for _, outkey := range outkeys {
+		valid, err := outputValid(outkey, this, servers, data.Down)
+		if err != nil || !valid {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func resumeTasks(tasks []*Task, data lib.MapArgs, this lib.Server, servers []lib.Server) ([]*Task, []string) {
+	done := make([]bool, len(tasks))
+	errs := make(chan error, len(tasks))
+	pool := semaphore.NewWeighted(maxResumeChecks)
+	for i, task := range tasks {
+		go func(i int, task *Task) {
 			// defer func() {}()
-			lib.With(cpuPool, func() {
-				result := lib.WarnTempdir(fmt.Sprintf("export filename=%s; < %s %s > output", path.Base(inpath), inpath, data.Cmd))
-				results <- MapResult{result, outkey}
+			var err error
+			lib.With(pool, func() {
+				done[i], err = taskDone(task, data, this, servers)
 			})
-		}(inpath)
-		count++
+			errs <- err
+		}(i, task)
 	}
-	var tempdirs []string
-	defer cleanup(&tempdirs)
-	timeout := time.After(lib.MaxTimeout)
-	jobs := make(chan error, len(*files))
-	fail := make(chan error, 1)
+	for range tasks {
+		panic1(<-errs)
+	}
+	var todo []*Task
+	var skipped []string
+	for i, task := range tasks {
+		if done[i] {
+			skipped = append(skipped, task.Key)
+		} else {
+			todo = append(todo, task)
+		}
+	}
+	return todo, skipped
+}
+
+func runJobHandler(w http.ResponseWriter, r *http.Request, kind string, this lib.Server, servers []lib.Server) {
+	id, data := parseMapArgs(r)
+	tasks, skipped := planJob(kind, data, this, servers)
+	if data.DryRun {
+		w.Header().Set("Content-Type", "application/json")
+		panic2(w.Write(panic2(json.Marshal(jobPlan(kind, tasks, skipped, this))).([]byte)))
+		return
+	}
+	job := newJob(r.Context(), id, kind, r.RemoteAddr, data, tasks, skipped)
+	appendJournal(job.report(this))
+	err := runTasks(job, tasks, this, servers)
+	job.finish(err)
+	appendJournal(job.report(this))
+	switch {
+	case errors.Is(err, context.Canceled):
+		lib.Logger.Printf("map job cancelled by client: %s\n", id)
+	case errors.Is(err, errTimeout):
+		w.WriteHeader(429)
+	case errors.Is(err, errKeysFailed):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(422)
+		panic2(w.Write(panic2(json.Marshal(job.report(this).Failures())).([]byte)))
+	case err != nil:
+		w.WriteHeader(500)
+		panic2(fmt.Fprintf(w, "%s", err))
+	default:
+		w.WriteHeader(200)
+	}
+}
+
+func jobPlan(kind string, tasks []*Task, skipped []string, this lib.Server) *lib.JobPlan {
+	plan := &lib.JobPlan{Server: this.Name, Kind: kind, Skipped: skipped}
+	for _, task := range tasks {
+		outputs := task.Outkey
+		if outputs == "" {
+			outputs = task.Outdir + "/"
+		}
+		plan.Tasks = append(plan.Tasks, lib.PlanTask{Group: task.Group, Inputs: task.Inputs, Outputs: outputs})
+	}
+	sort.Slice(plan.Tasks, func(i, j int) bool { return plan.Tasks[i].Outputs < plan.Tasks[j].Outputs })
+	sort.Strings(plan.Skipped)
+	return plan
+}
+
+func submitJobHandler(w http.ResponseWriter, r *http.Request, this lib.Server, servers []lib.Server) {
+	kind := lib.QueryParam(r, "kind")
+	id, data := parseMapArgs(r)
+	if data.DryRun {
+		w.WriteHeader(400)
+		panic2(fmt.Fprint(w, "dry run is not supported by async jobs, post to the map route instead"))
+		return
+	}
+	tasks, skipped := planJob(kind, data, this, servers)
+	job := newJob(context.Background(), id, kind, r.RemoteAddr, data, tasks, skipped)
+	appendJournal(job.report(this))
 	go func() {
 		// defer func() {}()
-		for i := 0; i < count; i++ {
-			result := <-results
-			tempdirs = append(tempdirs, result.WarnResult.Tempdir)
-			if result.WarnResult.Err != nil {
-				fail <- fmt.Errorf(result.WarnResult.Stdout + "\n" + result.WarnResult.Stderr)
-				break
+		job.finish(runTasks(job, tasks, this, servers))
+		appendJournal(job.report(this))
+	}()
+	panic2(fmt.Fprint(w, id))
+}
+
+func jobStatusHandler(w http.ResponseWriter, r *http.Request, this lib.Server) {
+	id := lib.QueryParam(r, "id")
+	v, ok := mapJobs.Load(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	panic2(w.Write(panic2(json.Marshal(v.(*Job).report(this))).([]byte)))
+}
+
+func journalHandler(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if val := lib.QueryParamDefault(r, "since", ""); val != "" {
+		since = panic2(time.Parse(time.RFC3339Nano, val)).(time.Time)
+	}
+	statuses, err := readJournal(since, lib.QueryParamDefault(r, "id", ""))
+	if err != nil {
+		w.WriteHeader(500)
+		panic2(fmt.Fprintf(w, "%s", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	panic2(w.Write(panic2(json.Marshal(statuses)).([]byte)))
+}
+
+func jobLogsHandler(w http.ResponseWriter, r *http.Request) {
+	id := lib.QueryParam(r, "id")
+	since := panic2(strconv.Atoi(lib.QueryParamDefault(r, "since", "0"))).(int)
+	v, ok := mapJobs.Load(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	panic2(w.Write(panic2(json.Marshal(v.(*Job).logsSince(since))).([]byte)))
+}
+
+func cancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := lib.QueryParam(r, "id")
+	v, ok := mapJobs.Load(id)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	v.(*Job).cancel()
+	w.WriteHeader(200)
+}
+
+func runTasks(job *Job, tasks []*Task, this lib.Server, servers []lib.Server) error {
+	defer job.unstage()
+	defer job.cancel()
+	timeout := time.After(lib.HandlerTimeout(job.args.TotalTimeout()))
+	err := runPhase(job, tasks, timeout, this, servers)
+	if job.args.Combine == "" || (err != nil && !errors.Is(err, errKeysFailed)) {
+		return err
+	}
+	combineErr := runPhase(job, job.combineTasks(this, servers), timeout, this, servers)
+	if combineErr != nil {
+		return combineErr
+	}
+	return err
+}
+
+func runPhase(job *Job, tasks []*Task, timeout <-chan time.Time, this lib.Server, servers []lib.Server) error {
+	errs := make(chan error, len(tasks))
+	for _, task := range tasks {
+		go func(task *Task) {
+			// defer func() {}()
+			errs <- runTask(job, task, this, servers)
+		}(task)
+	}
+	failed := false
+	for range tasks {
+		select {
+		case err := <-errs:
+			if err != nil && job.args.KeepGoing {
+				failed = true
+			} else if err != nil {
+				return err
+			}
+		case <-timeout:
+			return errTimeout
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		}
+	}
+	if failed {
+		return errKeysFailed
+	}
+	return nil
+}
+
+func runTask(job *Job, task *Task, this lib.Server, servers []lib.Server) error {
+	if job.args.Resume {
+		err := removeOutputs(task, job.args.Down, servers)
+		if err != nil {
+			job.keyStatus(task.Key, lib.KeyFailed, err)
+			return err
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		result, streamed, err := runAttempt(job, task, taskEnv(job, task, attempt, this, servers), this, servers)
+		if err != nil || job.ctx.Err() != nil {
+			if result != nil && result.Tempdir != "" {
+				_ = os.RemoveAll(result.Tempdir)
+			}
+			job.keyStatus(task.Key, lib.KeyCancelled, nil)
+			return job.ctx.Err()
+		}
+		if result.Err == nil && job.args.Combine != "" && task.Outkey == "" {
+			job.stage(task, result)
+			job.keyStatus(task.Key, lib.KeyDone, nil)
+			return nil
+		}
+		if result.Err == nil {
+			outkeys := streamed
+			if !job.args.Stream || task.Outkey != "" {
+				outkeys, err = putOutputs(task, result, job.args.Down, this, servers)
+			}
+			if err == nil && task.Outkey == "" {
+				err = writeResumeMarker(task, job.args, outkeys)
+			}
+			_ = os.RemoveAll(result.Tempdir)
+			if err != nil {
+				job.keyFailed(task.Key, result, err)
 			} else {
-				go func(result MapResult) {
-					// defer func() {}()
-					tempPath := lib.Join(result.WarnResult.Tempdir, "output")
-					err := localPut(tempPath, result.Outkey, this, servers)
-					if err != nil {
-						fail <- err
-					} else {
-						jobs <- nil
-					}
-				}(result)
+				job.keyStatus(task.Key, lib.KeyDone, nil)
 			}
+			return err
 		}
-	}()
-	for i := 0; i < count; i++ {
+		if result.Tempdir != "" {
+			_ = os.RemoveAll(result.Tempdir)
+		}
+		err = fmt.Errorf("%s\n%s", result.Stdout, result.Stderr)
+		if (result.Stdout == "" && result.Stderr == "") || errors.Is(result.Err, lib.ErrMemoryLimit) || errors.Is(result.Err, lib.ErrDiskLimit) {
+			err = result.Err
+		}
+		if attempt > job.args.Retries {
+			job.keyFailed(task.Key, result, err)
+			return err
+		}
+		delay := lib.RetryDelay(job.args.RetryBackoff, attempt)
+		job.log(task.Key, fmt.Sprintf("attempt %d failed: %s, retrying in %s", attempt, result.Err, delay))
 		select {
-		case <-jobs:
-		case err := <-fail:
-			w.WriteHeader(500)
-			panic2(fmt.Fprintf(w, "%s", err))
-			return
-		case <-timeout:
-			w.WriteHeader(429)
-			return
+		case <-time.After(delay):
+		case <-job.ctx.Done():
 		}
 	}
-	w.WriteHeader(200)
 }
 
-func localPut(tempPath string, key string, this lib.Server, servers []lib.Server) error {
-	if strings.Contains(key, " ") {
-		return fmt.Errorf("key contains space: %s", key)
+func (job *Job) stage(task *Task, result *lib.WarnResultTempdir) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	if job.ctx.Err() != nil {
+		_ = os.RemoveAll(result.Tempdir)
+		return
 	}
-	onThisServer, err := lib.OnThisServer(key, this, servers)
-	if err != nil {
-		return err
+	job.dirs = append(job.dirs, result.Tempdir)
+	for _, tempPath := range strings.Split(result.Stdout, "\n") {
+		if tempPath != "" {
+			job.staged = append(job.staged, stagedOutput{
+				inkey:  task.Key,
+				outkey: lib.Join(task.Outdir, path.Base(tempPath)),
+				path:   panic2(filepath.Abs(lib.Join(result.Tempdir, tempPath))).(string),
+			})
+		}
 	}
-	if !onThisServer {
-		return fmt.Errorf("wrong server for key: %s", key)
+}
+
+func (job *Job) unstage() {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	for _, dir := range job.dirs {
+		_ = os.RemoveAll(dir)
 	}
-	path := strings.SplitN(key, "s4://", 2)[1]
-	if strings.HasPrefix(path, "_") {
-		return fmt.Errorf("path cannot start with underscore: %s", path)
+	job.dirs = nil
+	job.staged = nil
+}
+
+func (job *Job) combineTasks(this lib.Server, servers []lib.Server) []*Task {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	groups := make(map[string][]stagedOutput)
+	for _, output := range job.staged {
+		prefix := lib.KeyPrefix(output.outkey)
+		groups[prefix] = append(groups[prefix], output)
 	}
-	var checksum string
-	lib.With(miscPool, func() {
-		checksum, err = lib.Checksum(tempPath)
+	cmd := job.args.Combine
+	if strings.HasPrefix(cmd, "while read") {
+		cmd = fmt.Sprintf("cat | %s", cmd)
+	}
+	outdir := lib.Join(job.args.Outdir, fmt.Sprintf("combine_%05d", serverIndex(this, servers)))
+	var tasks []*Task
+	for prefix, outputs := range groups {
+		var inkeys []string
+		var outkeys []string
+		var paths []string
+		for _, output := range outputs {
+			inkeys = append(inkeys, output.inkey)
+			outkeys = append(outkeys, output.outkey)
+			paths = append(paths, output.path)
+		}
+		outkey := lib.Join(outdir, lib.GroupName(prefix, outkeys))
+		tasks = append(tasks, &Task{
+			Key:    outkey,
+			Cmd:    fmt.Sprintf("%s > output", cmd),
+			Stdin:  strings.Join(paths, "\n") + "\n",
+			Outkey: outkey,
+			Group:  prefix,
+			Inputs: inkeys,
+			Staged: paths,
+		})
+		job.keys[outkey] = &lib.KeyStatus{Status: lib.KeyPending}
+	}
+	return tasks
+}
+
+func taskEnv(job *Job, task *Task, attempt int, this lib.Server, servers []lib.Server) []string {
+	env := serverEnv(task.Inputs[0], this, servers)
+	env = append(env, "S4_JOB_ID="+job.id, fmt.Sprintf("S4_ATTEMPT=%d", attempt))
+	switch {
+	case task.Group != "":
+		env = append(env, "S4_GROUP="+task.Group, fmt.Sprintf("S4_NUM_INPUTS=%d", len(task.Inputs)))
+	default:
+		env = append(env, "S4_KEY="+task.Key)
+	}
+	if task.Outkey != "" {
+		env = append(env, "S4_OUTKEY="+task.Outkey)
+	} else {
+		env = append(env, "S4_OUTDIR="+task.Outdir+"/")
+	}
+	return env
+}
+
+func serverIndex(this lib.Server, servers []lib.Server) int {
+	for i, server := range servers {
+		if server == this {
+			return i
+		}
+	}
+	return -1
+}
+
+func serverEnv(key string, this lib.Server, servers []lib.Server) []string {
+	bucket := strings.SplitN(strings.SplitN(key, "s4://", 2)[1], "/", 2)[0]
+	return []string{
+		"S4_BUCKET=" + bucket,
+		fmt.Sprintf("S4_SERVER_INDEX=%d", serverIndex(this, servers)),
+		fmt.Sprintf("S4_SERVER_COUNT=%d", len(servers)),
+	}
+}
+
+func runAttempt(job *Job, task *Task, env []string, this lib.Server, servers []lib.Server) (*lib.WarnResultTempdir, []string, error) {
+	var result *lib.WarnResultTempdir
+	var streamed []string
+	err := lib.WithContext(job.ctx, cpuPool, func() {
+		job.keyStatus(task.Key, lib.KeyRunning, nil)
+		stderr := &logWriter{job: job, key: task.Key}
+		opts := lib.CmdOpts{Stderr: stderr, Limits: job.args.Limits, Inputs: append(inputPaths(task.Inputs), task.Staged...), Env: env, Files: task.Files}
+		if task.Stdin != "" {
+			opts.Stdin = strings.NewReader(task.Stdin)
+		}
+		ctx, cancel := context.WithTimeout(job.ctx, job.args.Timeout)
+		defer cancel()
+		var stream *streamWriter
+		if job.args.Stream && task.Outkey == "" {
+			var cancelStream context.CancelCauseFunc
+			ctx, cancelStream = context.WithCancelCause(ctx)
+			defer cancelStream(nil)
+			opts.Tempdir = panic2(os.MkdirTemp("_tempdirs", "")).(string)
+			stream = &streamWriter{task: task, tempdir: opts.Tempdir, down: job.args.Down, this: this, servers: servers, cancel: cancelStream}
+			opts.Stdout = stream
+		}
+		result = lib.WarnTempdirContext(ctx, opts, "%s", task.Cmd)
+		stderr.flush()
+		if stream != nil {
+			var err error
+			streamed, err = stream.wait()
+			if err != nil && result.Err == nil {
+				result.Err = err
+			}
+			if result.Err != nil {
+				streamed = nil
+				err = removeOutputs(task, job.args.Down, servers)
+				if err != nil {
+					job.log(task.Key, fmt.Sprintf("failed to remove streamed outputs: %s", err))
+				}
+			}
+		}
+		if result.Err == nil && job.args.PartitionBy != "" && task.Outkey == "" {
+			partitionOutput(result, job.args)
+		}
 	})
-	if err != nil {
-		return err
+	return result, streamed, err
+}
+
+type streamWriter struct {
+	task    *Task
+	tempdir string
+	down    []int
+	this    lib.Server
+	servers []lib.Server
+	cancel  context.CancelCauseFunc
+	rest    []byte
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	outkeys []string
+	err     error
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	sw.rest = append(sw.rest, p...)
+	for {
+		i := bytes.IndexByte(sw.rest, '\n')
+		if i == -1 {
+			break
+		}
+		sw.ship(string(sw.rest[:i]))
+		sw.rest = sw.rest[i+1:]
+	}
+	return len(p), nil
+}
+
+func (sw *streamWriter) ship(tempPath string) {
+	if tempPath == "" {
+		return
 	}
-	lib.With(soloPool, func() {
-		err = confirmLocalPut(tempPath, path, checksum)
-	})
-	return err
+	outkey := lib.Join(sw.task.Outdir, path.Base(tempPath))
+	sw.wg.Add(1)
+	go func() {
+		// defer func() {}()
+		defer sw.wg.Done()
+		fullPath := lib.Join(sw.tempdir, tempPath)
+		err := serverPut(fullPath, outkey, sw.this, sw.servers, sw.down)
+		_ = os.Remove(fullPath)
+		sw.mutex.Lock()
+		defer sw.mutex.Unlock()
+		if err != nil {
+			if sw.err == nil {
+				sw.err = err
+				sw.cancel(err)
+			}
+			return
+		}
+		sw.outkeys = append(sw.outkeys, outkey)
+	}()
 }
 
-func confirmLocalPut(tempPath string, path string, checksum string) error {
-	err := os.MkdirAll(lib.Dir(path), os.ModePerm)
-	if err != nil {
-		return err
+func (sw *streamWriter) wait() ([]string, error) {
+	sw.ship(string(sw.rest))
+	sw.rest = nil
+	sw.wg.Wait()
+	return sw.outkeys, sw.err
+}
+
+func inputPaths(inkeys []string) []string {
+	var paths []string
+	for _, inkey := range inkeys {
+		paths = append(paths, panic2(filepath.Abs(strings.SplitN(inkey, "s4://", 2)[1])).(string))
 	}
-	exists, err := lib.Exists(path)
+	return paths
+}
+
+func partitionOutput(result *lib.WarnResultTempdir, args lib.MapArgs) {
+	p := panic2(lib.ParsePartitionBy(args.PartitionBy, args.Partitions)).(*lib.Partitioner)
+	output := lib.Join(result.Tempdir, "output")
+	names, err := p.PartitionFile(output, result.Tempdir)
 	if err != nil {
-		return err
+		result.Err = err
+		return
 	}
-	if exists {
-		return fmt.Errorf("fatal: key already exists s4://%s", path)
+	panic1(os.Remove(output))
+	result.Stdout = strings.Join(names, "\n")
+}
+
+func putOutputs(task *Task, result *lib.WarnResultTempdir, down []int, this lib.Server, servers []lib.Server) ([]string, error) {
+	var tempPaths []string
+	var outkeys []string
+	if task.Outkey != "" {
+		tempPaths = append(tempPaths, lib.Join(result.Tempdir, "output"))
+		outkeys = append(outkeys, task.Outkey)
+	} else {
+		for _, tempPath := range strings.Split(result.Stdout, "\n") {
+			if tempPath != "" {
+				tempPaths = append(tempPaths, lib.Join(result.Tempdir, tempPath))
+				outkeys = append(outkeys, lib.Join(task.Outdir, path.Base(tempPath)))
+			}
+		}
 	}
-	err = os.Chmod(tempPath, 0o444)
-	if err != nil {
-		return err
+	errs := make(chan error, len(tempPaths))
+	for i := range tempPaths {
+		go func(tempPath string, outkey string) {
+			// defer func() {}()
+			errs <- serverPut(tempPath, outkey, this, servers, down)
+		}(tempPaths[i], outkeys[i])
 	}
-	err = os.Rename(tempPath, path)
-	if err != nil {
-		return err
+	var err error
+	for range tempPaths {
+		e := <-errs
+		if e != nil && err == nil {
+			err = e
+		}
 	}
-	return lib.ChecksumWrite(path, checksum)
+	return outkeys, err
 }
 
-type MapToNResult struct {
-	WarnResult *lib.WarnResultTempdir
-	Inpath     string
-	Outdir     string
+func planMap(data lib.MapArgs, this lib.Server, servers []lib.Server) []*Task {
+	indir, glob := lib.ParseGlob(data.Indir)
+	outdir := data.Outdir
+	assert(strings.HasSuffix(indir, "/"), "indir not a directory: %s", indir)
+	assert(strings.HasSuffix(outdir, "/"), "outdir not a directory: %s", outdir)
+	pth := strings.SplitN(indir, "://", 2)[1]
+	files, _ := listRecursive(pth, true)
+	pth = strings.SplitN(pth, "/", 2)[1]
+	var tasks []*Task
+	for _, file := range *files {
+		size := file.Size
+		key := file.Path
+		if pth != "" {
+			key = strings.SplitN(key, pth, 2)[1]
+		}
+		if size == "PRE" {
+			continue
+		}
+		if glob != "" {
+			match := panic2(path.Match(glob, key)).(bool)
+			if !match {
+				continue
+			}
+		}
+		inkey := lib.Join(indir, key)
+		if !panic2(lib.IsPrimary(inkey, this, servers, data.Down)).(bool) {
+			continue
+		}
+		outkey := lib.Join(outdir, key)
+		inpath := panic2(filepath.Abs(strings.SplitN(inkey, "s4://", 2)[1])).(string)
+		cmd := fmt.Sprintf("< %s %s > output", inpath, data.Cmd)
+		if len(data.Cmds) > 0 {
+			cmd = fmt.Sprintf("%s > output", fuseCmds(inpath, append([]string{data.Cmd}, data.Cmds...)))
+		}
+		tasks = append(tasks, &Task{
+			Key:    inkey,
+			Cmd:    fmt.Sprintf("export filename=%s; %s", path.Base(inpath), cmd),
+			Outkey: outkey,
+			Inputs: []string{inkey},
+		})
+	}
+	return tasks
 }
 
-func cleanup(tempdirs *[]string) {
-	for _, tempdir := range *tempdirs {
-		panic1(os.RemoveAll(tempdir))
+func fuseCmds(inpath string, cmds []string) string {
+	var stages []string
+	for i, cmd := range cmds {
+		if strings.HasPrefix(cmd, "while read") {
+			cmd = fmt.Sprintf("cat | %s", cmd)
+		}
+		stage := fmt.Sprintf("{ bash -c %s || { code=$?; [ $code = 141 ] || echo \"stage %d failed: exit $code\" >&2; exit $code; }; }", lib.ShellQuote("set -eou pipefail; "+cmd), i+1)
+		if i == 0 {
+			stage = fmt.Sprintf("%s < %s", stage, inpath)
+		}
+		stages = append(stages, stage)
 	}
+	return strings.Join(stages, " | ")
 }
 
-func mapToNHandler(w http.ResponseWriter, r *http.Request, this lib.Server, servers []lib.Server) {
-	var data lib.MapArgs
-	defer func() { _ = r.Body.Close() }()
-	bytes := panic2(io.ReadAll(r.Body)).([]byte)
-	panic1(json.Unmarshal(bytes, &data))
+func planMapToN(data lib.MapArgs, this lib.Server, servers []lib.Server) []*Task {
 	indir, glob := lib.ParseGlob(data.Indir)
 	outdir := data.Outdir
-	assert(strings.HasSuffix(indir, "/"), fmt.Sprintf("indir not a directory: %s", indir))
-	assert(strings.HasSuffix(outdir, "/"), fmt.Sprintf("outdir not a directory: %s", outdir))
-	assert(strings.HasPrefix(outdir, "s4://"), fmt.Sprintf("outdir must start with s4://, got: %s", outdir))
+	assert(strings.HasSuffix(indir, "/"), "indir not a directory: %s", indir)
+	assert(strings.HasSuffix(outdir, "/"), "outdir not a directory: %s", outdir)
+	assert(strings.HasPrefix(outdir, "s4://"), "outdir must start with s4://, got: %s", outdir)
 	pth := strings.SplitN(indir, "://", 2)[1]
 	files, _ := listRecursive(pth, true)
 	pth = strings.SplitN(pth, "/", 2)[1]
-	if strings.HasPrefix(data.Cmd, "while read") {
-		data.Cmd = fmt.Sprintf("cat | %s", data.Cmd)
-	}
-	count := 0
-	results := make(chan MapToNResult, len(*files))
+	var tasks []*Task
 	for _, file := range *files {
 		size := file.Size
 		key := file.Path
 		if pth != "" {
 			key = strings.SplitN(key, pth, 2)[1]
 		}
-		assert(size != "PRE", fmt.Sprintf("map-to-n got a directory instead of a key: %s", key))
+		assert(size != "PRE", "map-to-n got a directory instead of a key: %s", key)
 		if glob != "" {
 			match := panic2(path.Match(glob, key)).(bool)
 			if !match {
@@ -395,103 +1335,101 @@ func mapToNHandler(w http.ResponseWriter, r *http.Request, this lib.Server, serv
 			}
 		}
 		inkey := lib.Join(indir, key)
+		if !panic2(lib.IsPrimary(inkey, this, servers, data.Down)).(bool) {
+			continue
+		}
 		inpath := panic2(filepath.Abs(strings.SplitN(inkey, "s4://", 2)[1])).(string)
-		go func(inpath string) {
-			// defer func() {}()
-			lib.With(cpuPool, func() {
-				result := lib.WarnTempdir(fmt.Sprintf("export filename=%s; < %s %s", path.Base(inpath), inpath, data.Cmd))
-				results <- MapToNResult{result, inpath, outdir}
-			})
-		}(inpath)
-		count++
-	}
-	var tempdirs []string
-	defer cleanup(&tempdirs)
-	timeout := time.After(lib.MaxTimeout)
-	fail := make(chan error)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		// defer func() {}()
-		for i := 0; i < count; i++ {
-			result := <-results
-			tempdirs = append(tempdirs, result.WarnResult.Tempdir)
-			if result.WarnResult.Err != nil {
-				fail <- fmt.Errorf(result.WarnResult.Stdout + "\n" + result.WarnResult.Stderr)
-				break
-			} else {
-				for _, tempPath := range strings.Split(result.WarnResult.Stdout, "\n") {
-					if tempPath != "" {
-						wg.Add(1)
-						tempPath = lib.Join(result.WarnResult.Tempdir, tempPath)
-						outkey := lib.Join(result.Outdir, path.Base(result.Inpath), path.Base(tempPath))
-						go mapToNPut(&wg, fail, tempPath, outkey, this, servers)
-					}
-				}
+		cmd := data.Cmd
+		if data.PartitionBy != "" {
+			if cmd == "" {
+				cmd = "cat"
 			}
+			cmd = fmt.Sprintf("%s > output", cmd)
 		}
-		wg.Done()
-	}()
-	select {
-	case err := <-fail:
-		w.WriteHeader(500)
-		panic2(fmt.Fprintf(w, "%s", err))
-	case <-lib.Await(&wg):
-		w.WriteHeader(200)
-	case <-timeout:
-		w.WriteHeader(429)
+		tasks = append(tasks, &Task{
+			Key:    inkey,
+			Cmd:    fmt.Sprintf("export filename=%s; < %s %s", path.Base(inpath), inpath, cmd),
+			Outdir: lib.Join(outdir, path.Base(inpath)),
+			Inputs: []string{inkey},
+		})
 	}
+	return tasks
 }
 
-func mapToNPut(wg *sync.WaitGroup, fail chan<- error, tempPath string, outkey string, this lib.Server, servers []lib.Server) {
-	defer wg.Done()
-	onThisServer, err := lib.OnThisServer(outkey, this, servers)
-	if err != nil {
-		fail <- err
-		return
+func planMapFromN(data lib.MapArgs, this lib.Server, servers []lib.Server) []*Task {
+	outdir := data.Outdir
+	assert(strings.HasSuffix(outdir, "/"), "outdir not a directory: %s", outdir)
+	assert(strings.HasPrefix(outdir, "s4://") && strings.HasSuffix(outdir, "/"), "%s", outdir)
+	var tasks []*Task
+	for prefix, inkeys := range groupByPrefix(data.Indir, this, servers, data.Down) {
+		outkey := lib.Join(outdir, lib.GroupName(prefix, inkeys))
+		tasks = append(tasks, &Task{
+			Key:    outkey,
+			Cmd:    fmt.Sprintf("%s > output", data.Cmd),
+			Stdin:  strings.Join(inputPaths(inkeys), "\n") + "\n",
+			Outkey: outkey,
+			Group:  prefix,
+			Inputs: inkeys,
+		})
 	}
-	if onThisServer {
-		err := localPut(tempPath, outkey, this, servers)
-		if err != nil {
-			fail <- err
+	return tasks
+}
+
+func planJoin(data lib.MapArgs, this lib.Server, servers []lib.Server) []*Task {
+	outdir := data.Outdir
+	assert(strings.HasSuffix(outdir, "/"), "outdir not a directory: %s", outdir)
+	assert(strings.HasPrefix(outdir, "s4://"), "outdir must start with s4://, got: %s", outdir)
+	join := data.Join
+	if join == "" {
+		join = lib.JoinInner
+	}
+	assert(lib.Contains([]string{lib.JoinInner, lib.JoinLeft, lib.JoinOuter}, join), "join must be one of inner, left, outer, got: %s", join)
+	left := groupByPrefix(data.Indir, this, servers, data.Down)
+	right := groupByPrefix(data.JoinIndir, this, servers, data.Down)
+	prefixes := make(map[string]bool)
+	for prefix := range left {
+		_, ok := right[prefix]
+		prefixes[prefix] = ok || join != lib.JoinInner
+	}
+	for prefix := range right {
+		_, ok := left[prefix]
+		prefixes[prefix] = ok || join == lib.JoinOuter
+	}
+	var tasks []*Task
+	for prefix, ok := range prefixes {
+		if !ok {
+			continue
 		}
-	} else {
-		err := lib.Retry(func() error {
-			var err error
-			lib.With(ioSendPool, func() {
-				err = s4.PutFile(tempPath, outkey, servers)
-			})
-			if errors.Is(err, s4.Err409) {
-				fail <- err
-				return nil
-			}
-			return err
-		})
-		if err != nil {
-			fail <- err
+		inkeys := append(append([]string{}, left[prefix]...), right[prefix]...)
+		outkey := lib.Join(outdir, lib.GroupName(prefix, inkeys))
+		files := map[string]string{"_left": "", "_right": ""}
+		if len(left[prefix]) > 0 {
+			files["_left"] = strings.Join(inputPaths(left[prefix]), "\n") + "\n"
 		}
+		if len(right[prefix]) > 0 {
+			files["_right"] = strings.Join(inputPaths(right[prefix]), "\n") + "\n"
+		}
+		tasks = append(tasks, &Task{
+			Key:    outkey,
+			Cmd:    fmt.Sprintf("export S4_LEFT=$PWD/_left S4_RIGHT=$PWD/_right; %s > output", data.Cmd),
+			Files:  files,
+			Outkey: outkey,
+			Group:  prefix,
+			Inputs: inkeys,
+		})
 	}
+	return tasks
 }
 
-func mapFromNHandler(w http.ResponseWriter, r *http.Request, this lib.Server, servers []lib.Server) {
-	var data lib.MapArgs
-	defer func() { _ = r.Body.Close() }()
-	bytes := panic2(io.ReadAll(r.Body)).([]byte)
-	panic1(json.Unmarshal(bytes, &data))
-	indir, glob := lib.ParseGlob(data.Indir)
-	outdir := data.Outdir
-	assert(strings.HasSuffix(indir, "/"), fmt.Sprintf("indir not a directory: %s", indir))
-	assert(strings.HasSuffix(outdir, "/"), fmt.Sprintf("outdir not a directory: %s", outdir))
-	assert(strings.HasPrefix(outdir, "s4://") && strings.HasSuffix(outdir, "/"), outdir)
+func groupByPrefix(indir string, this lib.Server, servers []lib.Server, down []int) map[string][]string {
+	indir, glob := lib.ParseGlob(indir)
+	assert(strings.HasSuffix(indir, "/"), "indir not a directory: %s", indir)
 	pth := strings.Split(indir, "://")[1]
 	files, _ := listRecursive(pth, true)
 	parts := strings.SplitN(pth, "/", 2)
 	bucket := parts[0]
 	indir = parts[1]
-	if strings.HasPrefix(data.Cmd, "while read") {
-		data.Cmd = fmt.Sprintf("cat | %s", data.Cmd)
-	}
-	prefixes := make(map[string][]string)
+	inkeys := make(map[string][]string)
 	for _, file := range *files {
 		key := file.Path
 		if indir != "" {
@@ -503,61 +1441,14 @@ func mapFromNHandler(w http.ResponseWriter, r *http.Request, this lib.Server, se
 				continue
 			}
 		}
-		prefix := lib.KeyPrefix(key)
-		prefixes[prefix] = append(prefixes[prefix], panic2(filepath.Abs(lib.Join(bucket, indir, key))).(string))
-	}
-	results := make(chan MapResult, len(prefixes))
-	for prefix, inpaths := range prefixes {
-		outkey := lib.Join(outdir, prefix+lib.Suffix(inpaths))
-		go func(inpaths []string) {
-			// defer func() {}()
-			lib.With(cpuPool, func() {
-				stdin := strings.NewReader(strings.Join(inpaths, "\n") + "\n")
-				result := lib.WarnTempdirStreamIn(stdin, fmt.Sprintf("%s > output", data.Cmd))
-				results <- MapResult{result, outkey}
-			})
-		}(inpaths)
-	}
-	var tempdirs []string
-	defer cleanup(&tempdirs)
-	timeout := time.After(lib.MaxTimeout)
-	jobs := make(chan error, len(prefixes))
-	fail := make(chan error, 1)
-	go func() {
-		// defer func() {}()
-		for range prefixes {
-			result := <-results
-			tempdirs = append(tempdirs, result.WarnResult.Tempdir)
-			if result.WarnResult.Err != nil {
-				fail <- fmt.Errorf(result.WarnResult.Stdout + "\n" + result.WarnResult.Stderr)
-				break
-			} else {
-				go func(result MapResult) {
-					// defer func() {}()
-					tempPath := lib.Join(result.WarnResult.Tempdir, "output")
-					err := localPut(tempPath, result.Outkey, this, servers)
-					if err != nil {
-						fail <- err
-					} else {
-						jobs <- nil
-					}
-				}(result)
-			}
-		}
-	}()
-	for range prefixes {
-		select {
-		case <-jobs:
-		case err := <-fail:
-			w.WriteHeader(500)
-			panic2(fmt.Fprintf(w, "%s", err))
-			return
-		case <-timeout:
-			w.WriteHeader(429)
-			return
+		inkey := fmt.Sprintf("s4://%s", lib.Join(bucket, indir, key))
+		if !panic2(lib.IsPrimary(inkey, this, servers, down)).(bool) {
+			continue
 		}
+		prefix := lib.KeyPrefix(inkey)
+		inkeys[prefix] = append(inkeys[prefix], inkey)
 	}
-	w.WriteHeader(200)
+	return inkeys
 }
 
 func evalHandler(w http.ResponseWriter, r *http.Request, this lib.Server, servers []lib.Server) {
@@ -573,17 +1464,217 @@ func evalHandler(w http.ResponseWriter, r *http.Request, this lib.Server, server
 	if !exists {
 		w.WriteHeader(404)
 	} else {
-		lib.With(cpuPool, func() {
-			res := lib.Warn("< %s %s", path, cmd)
+		_ = lib.WithContext(r.Context(), cpuPool, func() {
+			var res *lib.WarnResult
+			env := append(serverEnv(key, this, servers), "S4_KEY="+key)
+			if lib.Sandbox != nil {
+				inpaths := inputPaths([]string{key})
+				result := lib.WarnTempdirContext(r.Context(), lib.CmdOpts{Inputs: inpaths, Env: env}, "< %s %s", inpaths[0], cmd)
+				if result.Tempdir != "" {
+					panic1(os.RemoveAll(result.Tempdir))
+				}
+				res = &lib.WarnResult{Stdout: result.Stdout, Stderr: result.Stderr, Err: result.Err}
+			} else {
+				res = lib.WarnEnvContext(r.Context(), env, "< %s %s", path, cmd)
+			}
 			if res.Err != nil {
 				w.WriteHeader(500)
-				panic2(fmt.Fprintf(w, res.Stdout+"\n"+res.Stderr))
+				panic2(fmt.Fprintf(w, "%s\n%s", res.Stdout, res.Stderr))
 			} else {
 				w.WriteHeader(200)
-				panic2(fmt.Fprintf(w, res.Stdout))
+				panic2(fmt.Fprint(w, res.Stdout))
+			}
+		})
+	}
+}
+
+func checksumHandler(w http.ResponseWriter, r *http.Request) {
+	key := lib.QueryParam(r, "key")
+	path := strings.SplitN(key, "s4://", 2)[1]
+	if lib.QueryParamDefault(r, "verify", "false") == "true" {
+		valid := panic2(verifyLocal(path)).(bool)
+		if !valid {
+			w.WriteHeader(404)
+			return
+		}
+	}
+	var exists bool
+	var checksum string
+	lib.With(soloPool, func() {
+		exists = panic2(lib.Exists(path)).(bool)
+		if exists {
+			checksum = panic2(lib.ChecksumRead(path)).(string)
+		}
+	})
+	if !exists {
+		w.WriteHeader(404)
+		return
+	}
+	panic2(fmt.Fprint(w, checksum))
+}
+
+func listAll() ([]*File, []*File) {
+	var files []*File
+	var dirs []*File
+	for _, info := range readDir(".") {
+		if info.IsDir() && !strings.HasPrefix(info.Name(), "_") {
+			f, d := listRecursive(info.Name()+"/", false)
+			files = append(files, *f...)
+			dirs = append(dirs, *d...)
+		}
+	}
+	return files, dirs
+}
+
+func duHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := lib.QueryParamDefault(r, "prefix", "")
+	var files []*File
+	lib.With(miscPool, func() {
+		if prefix == "" {
+			files, _ = listAll()
+		} else {
+			assert(strings.HasPrefix(prefix, "s4://"), "%s", prefix)
+			f, _ := listRecursive(strings.SplitN(prefix, "s4://", 2)[1], false)
+			files = *f
+		}
+	})
+	usage := s4.Usage{}
+	for _, file := range files {
+		usage.Keys++
+		usage.Bytes += panic2(strconv.ParseInt(file.Size, 10, 64)).(int64)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	panic2(w.Write(panic2(json.Marshal(usage)).([]byte)))
+}
+
+func rebalanceHandler(w http.ResponseWriter, this lib.Server, servers []lib.Server) {
+	var files []*File
+	lib.With(miscPool, func() {
+		files, _ = listAll()
+	})
+	type result struct {
+		path    string
+		sent    bool
+		removed bool
+		err     error
+	}
+	results := make(chan result, len(files))
+	for _, file := range files {
+		go func(path string) {
+			// defer func() {}()
+			sent, removed, err := rebalanceKey(path, this, servers)
+			results <- result{path, sent, removed, err}
+		}(file.Path)
+	}
+	count := 0
+	var errs []string
+	emptied := make(map[string]bool)
+	for range files {
+		r := <-results
+		if r.sent {
+			count++
+		}
+		if r.removed {
+			for dir := path.Dir(r.path); dir != "."; dir = path.Dir(dir) {
+				emptied[dir] = true
+			}
+		}
+		if r.err != nil {
+			errs = append(errs, r.err.Error())
+		}
+	}
+	var dirs []string
+	for dir := range emptied {
+		dirs = append(dirs, dir)
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	lib.With(soloPool, func() {
+		for _, dir := range dirs {
+			_ = os.Remove(dir)
+		}
+	})
+	if len(errs) != 0 {
+		w.WriteHeader(500)
+		panic2(fmt.Fprintf(w, "sent %d keys, failed %d keys:\n%s", count, len(errs), strings.Join(errs, "\n")))
+		return
+	}
+	panic2(fmt.Fprintf(w, "%d", count))
+}
+
+func rebalanceKey(path string, this lib.Server, servers []lib.Server) (bool, bool, error) {
+	key := fmt.Sprintf("s4://%s", path)
+	replicas, err := lib.PickServers(key, servers)
+	if err != nil {
+		return false, false, err
+	}
+	placed := false
+	var targets []lib.Server
+	for _, server := range replicas {
+		if server == this {
+			placed = true
+		} else {
+			targets = append(targets, server)
+		}
+	}
+	var checksum string
+	var diskChecksum string
+	lib.With(miscPool, func() {
+		checksum, err = lib.Checksum(path)
+		if err == nil {
+			diskChecksum, err = lib.ChecksumRead(path)
+		}
+	})
+	if err != nil {
+		return false, false, err
+	}
+	if checksum != diskChecksum {
+		return false, false, fmt.Errorf("checksum mismatch on disk: %s %s %s", key, checksum, diskChecksum)
+	}
+	sent := false
+	for _, server := range targets {
+		var conflict error
+		copied := false
+		err := lib.Retry(func() error {
+			var err error
+			lib.With(ioSendPool, func() {
+				err = s4.PutFileTo(path, key, server)
+			})
+			if !errors.Is(err, s4.Err409) {
+				copied = err == nil
+				return err
+			}
+			result := lib.Get(fmt.Sprintf("http://%s/checksum?key=%s", server.HostPort(), key))
+			switch {
+			case result.Err != nil:
+				return result.Err
+			case result.StatusCode == 404:
+				return fmt.Errorf("put in progress on %s: %s", server.HostPort(), key)
+			case result.StatusCode != 200 || string(result.Body) != checksum:
+				conflict = fmt.Errorf("conflicting key on %s: %s", server.HostPort(), key)
 			}
+			return nil
 		})
+		if err != nil {
+			return sent, false, err
+		}
+		if conflict != nil {
+			return sent, false, conflict
+		}
+		sent = sent || copied
 	}
+	if placed {
+		return sent, false, nil
+	}
+	lib.With(soloPool, func() {
+		err = os.Remove(path)
+		if err == nil {
+			err = os.Remove(panic2(lib.ChecksumPath(path)).(string))
+		}
+	})
+	if err != nil {
+		return sent, false, err
+	}
+	return true, true, nil
 }
 
 type File struct {
@@ -622,6 +1713,18 @@ func listRecursive(prefix string, stripBucket bool) (*[]*File, *[]*File) {
 	return &files, &dirs
 }
 
+func readDir(root string) []os.FileInfo {
+	var infos []os.FileInfo
+	for _, entry := range panic2(os.ReadDir(root)).([]os.DirEntry) {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
 func list(prefix string) *[]*File {
 	root := prefix
 	if !strings.HasSuffix(prefix, "/") && strings.Count(prefix, "/") > 0 {
@@ -630,7 +1733,7 @@ func list(prefix string) *[]*File {
 	var res []*File
 	_, err := os.Stat(root)
 	if err == nil {
-		for _, info := range panic2(os.ReadDir(root)).([]os.FileInfo) {
+		for _, info := range readDir(root) {
 			name := info.Name()
 			matched := strings.HasPrefix(lib.Join(root, name), prefix)
 			isChecksum := lib.IsChecksum(name)
@@ -648,7 +1751,7 @@ func list(prefix string) *[]*File {
 
 func listHandler(w http.ResponseWriter, r *http.Request) {
 	prefix := lib.QueryParam(r, "prefix")
-	assert(strings.HasPrefix(prefix, "s4://"), prefix)
+	assert(strings.HasPrefix(prefix, "s4://"), "%s", prefix)
 	prefix = strings.Split(prefix, "s4://")[1]
 	recursive := lib.QueryParamDefault(r, "recursive", "false") == "true"
 	var res *[]*File
@@ -674,7 +1777,7 @@ func listHandler(w http.ResponseWriter, r *http.Request) {
 
 func listBucketsHandler(w http.ResponseWriter) {
 	var res [][]string
-	for _, info := range panic2(os.ReadDir(".")).([]os.FileInfo) {
+	for _, info := range readDir(".") {
 		name := info.Name()
 		if info.IsDir() && !strings.HasPrefix(name, "_") {
 			parts := strings.SplitN(info.ModTime().Format(time.RFC3339), "T", 2)
@@ -729,7 +1832,7 @@ func expireJobs() {
 
 func expireFiles() {
 	root := "_tempfiles"
-	for _, info := range panic2(os.ReadDir(root)).([]os.FileInfo) {
+	for _, info := range readDir(root) {
 		if time.Since(info.ModTime()) > lib.MaxTimeout {
 			path := lib.Join(root, info.Name())
 			lib.Logger.Printf("gc expired tempfile: %s\n", path)
@@ -740,8 +1843,8 @@ func expireFiles() {
 
 func expireDirs() {
 	root := "_tempdirs"
-	for _, info := range panic2(os.ReadDir(root)).([]os.FileInfo) {
-		if time.Since(info.ModTime()) > lib.MaxTimeout {
+	for _, info := range readDir(root) {
+		if time.Since(info.ModTime()) > lib.HandlerTimeout(maxTimeout) {
 			path := lib.Join(root, info.Name())
 			lib.Logger.Printf("gc expired tempdir: %s\n", path)
 			_ = os.RemoveAll(path)
@@ -749,10 +1852,34 @@ func expireDirs() {
 	}
 }
 
+func expireMapJobs() {
+	mapJobs.Range(func(k, v interface{}) bool {
+		job := v.(*Job)
+		job.mutex.Lock()
+		expired := job.status != lib.JobRunning && time.Since(job.end) > jobRetention
+		job.mutex.Unlock()
+		if expired {
+			lib.Logger.Printf("gc expired map job: %s\n", k)
+			mapJobs.Delete(k)
+		}
+		return true
+	})
+}
+
+func expireResumeMarkers() {
+	for _, info := range readDir(resumeDir) {
+		if time.Since(info.ModTime()) > resumeRetention {
+			_ = os.Remove(lib.Join(resumeDir, info.Name()))
+		}
+	}
+}
+
 func expiredDataDeleter() {
 	// defer func() {}()
 	for {
+		expireResumeMarkers()
 		expireJobs()
+		expireMapJobs()
 		expireFiles()
 		expireDirs()
 		time.Sleep(time.Second * 5)
@@ -777,6 +1904,16 @@ func rootHandler(w http.ResponseWriter, r *http.Request, this lib.Server, server
 			listBucketsHandler(w)
 		case "/health":
 			healthHandler(w)
+		case "/checksum":
+			checksumHandler(w, r)
+		case "/du":
+			duHandler(w, r)
+		case "/jobs":
+			jobStatusHandler(w, r, this)
+		case "/logs":
+			jobLogsHandler(w, r)
+		case "/journal":
+			journalHandler(w, r)
 		default:
 			notFoundHandler(w)
 		}
@@ -793,13 +1930,21 @@ func rootHandler(w http.ResponseWriter, r *http.Request, this lib.Server, server
 		case "/delete":
 			deleteHandler(r, this, servers)
 		case "/map":
-			mapHandler(w, r, this, servers)
+			runJobHandler(w, r, lib.KindMap, this, servers)
 		case "/map_to_n":
-			mapToNHandler(w, r, this, servers)
+			runJobHandler(w, r, lib.KindMapToN, this, servers)
 		case "/map_from_n":
-			mapFromNHandler(w, r, this, servers)
+			runJobHandler(w, r, lib.KindMapFromN, this, servers)
+		case "/join":
+			runJobHandler(w, r, lib.KindJoin, this, servers)
+		case "/jobs":
+			submitJobHandler(w, r, this, servers)
+		case "/cancel":
+			cancelJobHandler(w, r)
 		case "/eval":
 			evalHandler(w, r, this, servers)
+		case "/rebalance":
+			rebalanceHandler(w, this, servers)
 		default:
 			notFoundHandler(w)
 		}
@@ -812,14 +1957,28 @@ func main() {
 	panic1(os.Setenv("LC_ALL", "C"))
 	panic1(os.MkdirAll("s4_data/_tempfiles", os.ModePerm))
 	panic1(os.MkdirAll("s4_data/_tempdirs", os.ModePerm))
+	panic1(os.MkdirAll("s4_data/_resume", os.ModePerm))
+	panic1(os.MkdirAll("s4_data/_jobs", os.ModePerm))
 	panic1(os.Chdir("s4_data"))
+	repairJournal()
 	numCpus := runtime.GOMAXPROCS(0)
 	port := flag.Int("port", 0, "specify port instead of matching a single conf entry by ipv4")
 	maxIOJobs := flag.Int("max-io-jobs", numCpus*4, "specify max-io-jobs to use instead of cpus*4")
 	maxCPUJobs := flag.Int("max-cpu-jobs", numCpus+2, "specify max-cpu-jobs to use instead of cpus+2")
 	confPath := flag.String("conf", lib.DefaultConfPath(), "specify conf path to use instead of ~/.s4.conf")
+	cgroup := flag.String("cgroup", "", "specify a cgroup v2 dir to create per cmd cgroups in, instead of falling back to rlimits")
+	flag.DurationVar(&maxTimeout, "max-timeout", 24*time.Hour, "specify the max per job cmd timeout clients may request")
+	flag.DurationVar(&jobRetention, "job-retention", time.Hour, "specify how long to keep finished map job status")
+	sandbox := flag.Bool("sandbox", false, "run map and eval cmds in mount, pid, and net namespaces that only see their inputs, tempdir, and -sandbox-ro paths")
+	sandboxRO := flag.String("sandbox-ro", "/bin,/sbin,/usr,/lib,/lib32,/lib64,/etc", "specify comma separated paths to mount read-only in the sandbox")
 	flag.Parse()
 	initPools(*maxIOJobs, *maxCPUJobs)
+	if *cgroup != "" {
+		panic1(lib.InitCgroup(*cgroup))
+	}
+	if *sandbox {
+		panic1(lib.InitSandbox(strings.Split(*sandboxRO, ",")))
+	}
 	servers := panic2(lib.GetServers(*confPath)).([]lib.Server)
 	this := lib.ThisServer(*port, servers)
 	portStr := fmt.Sprintf(":%s", this.Port)
@@ -827,7 +1986,7 @@ func main() {
 	go expiredDataDeleter()
 	server := &http.Server{
 		ReadTimeout:  lib.MaxTimeout,
-		WriteTimeout: lib.MaxTimeout,
+		WriteTimeout: lib.HandlerTimeout(maxTimeout),
 		IdleTimeout:  lib.MaxTimeout,
 		Addr:         portStr,
 		Handler: &lib.RootHandler{
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
@@ -16,9 +17,12 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/avast/retry-go"
@@ -41,11 +45,199 @@ var (
 )
 
 type MapArgs struct {
-	Cmd    string `json:"cmd"`
-	Indir  string `json:"indir"`
-	Outdir string `json:"outidr"`
+	Cmd          string        `json:"cmd"`
+	Cmds         []string      `json:"cmds"`
+	Indir        string        `json:"indir"`
+	Outdir       string        `json:"outidr"`
+	Down         []int         `json:"down"`
+	Timeout      time.Duration `json:"timeout"`
+	Retries      int           `json:"retries"`
+	RetryBackoff time.Duration `json:"retry_backoff"`
+	KeepGoing    bool          `json:"keep_going"`
+	Limits       Limits        `json:"limits"`
+	Resume       bool          `json:"resume"`
+	DryRun       bool          `json:"dry_run"`
+	JoinIndir    string        `json:"join_indir"`
+	Join         string        `json:"join"`
+	Combine      string        `json:"combine"`
+	PartitionBy  string        `json:"partition_by"`
+	Partitions   int           `json:"partitions"`
+	Stream       bool          `json:"stream"`
 }
 
+func (args MapArgs) TotalTimeout() time.Duration {
+	timeout := args.Timeout
+	if timeout == 0 {
+		timeout = Timeout
+	}
+	total := timeout * time.Duration(args.Retries+1)
+	for attempt := 1; attempt <= args.Retries; attempt++ {
+		total += RetryDelay(args.RetryBackoff, attempt)
+	}
+	if args.Combine != "" {
+		total *= 2
+	}
+	return total
+}
+
+func RetryDelay(backoff time.Duration, attempt int) time.Duration {
+	if attempt > 10 {
+		attempt = 10
+	}
+	return backoff << (attempt - 1)
+}
+
+const (
+	KindMap        = "map"
+	KindMapToN     = "map_to_n"
+	KindMapFromN   = "map_from_n"
+	KindJoin       = "join"
+	JoinInner      = "inner"
+	JoinLeft       = "left"
+	JoinOuter      = "outer"
+	JobRunning     = "running"
+	JobSucceeded   = "succeeded"
+	JobFailed      = "failed"
+	JobCancelled   = "cancelled"
+	JobInterrupted = "interrupted"
+	KeyPending     = "pending"
+	KeyRunning     = "running"
+	KeyDone        = "done"
+	KeyFailed      = "failed"
+	KeyCancelled   = "cancelled"
+	KeySkipped     = "skipped"
+)
+
+type JobStatus struct {
+	ID        string                `json:"id"`
+	Kind      string                `json:"kind"`
+	Server    string                `json:"server"`
+	Requester string                `json:"requester"`
+	Args      MapArgs               `json:"args"`
+	Status    string                `json:"status"`
+	Error     string                `json:"error"`
+	Start     time.Time             `json:"start"`
+	End       time.Time             `json:"end"`
+	Keys      map[string]*KeyStatus `json:"keys"`
+}
+
+type KeyStatus struct {
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	StderrTail string    `json:"stderr_tail"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Error      string    `json:"error"`
+}
+
+type JobPlan struct {
+	Server  string     `json:"server"`
+	Kind    string     `json:"kind"`
+	Tasks   []PlanTask `json:"tasks"`
+	Skipped []string   `json:"skipped"`
+}
+
+type PlanTask struct {
+	Group   string   `json:"group"`
+	Inputs  []string `json:"inputs"`
+	Outputs string   `json:"outputs"`
+}
+
+type KeyFailure struct {
+	Key        string `json:"key"`
+	Server     string `json:"server"`
+	ExitCode   *int   `json:"exit_code,omitempty"`
+	StderrTail string `json:"stderr_tail"`
+	Error      string `json:"error"`
+}
+
+func (failure KeyFailure) Exit() string {
+	if failure.ExitCode == nil {
+		return "-"
+	}
+	return strconv.Itoa(*failure.ExitCode)
+}
+
+func (failure KeyFailure) LastLine() string {
+	text := failure.StderrTail
+	if text == "" {
+		text = failure.Error
+	}
+	return Tail(strings.TrimSpace(text), 1)
+}
+
+func (status *JobStatus) Failures() []KeyFailure {
+	var failures []KeyFailure
+	for key, ks := range status.Keys {
+		if ks.Status == KeyFailed {
+			failures = append(failures, KeyFailure{
+				Key:        key,
+				Server:     status.Server,
+				ExitCode:   ks.ExitCode,
+				StderrTail: ks.StderrTail,
+				Error:      ks.Error,
+			})
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool { return failures[i].Key < failures[j].Key })
+	return failures
+}
+
+func ExitCode(err error) int {
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &exitErr):
+		return exitErr.ExitCode()
+	default:
+		return -1
+	}
+}
+
+func Tail(s string, lines int) string {
+	parts := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(parts) > lines {
+		parts = parts[len(parts)-lines:]
+	}
+	return strings.Join(parts, "\n")
+}
+
+type JobLogLine struct {
+	Key  string `json:"key"`
+	Line string `json:"line"`
+}
+
+type JobLogs struct {
+	Lines []JobLogLine `json:"lines"`
+	Next  int          `json:"next"`
+	Done  bool         `json:"done"`
+}
+
+type ClusterConf struct {
+	Replicas   int
+	Placement  string
+	Partitions map[string]*PartitionRule
+	Hash       string
+}
+
+type PartitionRule struct {
+	Regexp  *regexp.Regexp
+	Numeric bool
+}
+
+const ConfHashHeader = "S4-Conf-Hash"
+
+const (
+	PlacementModulo     = "modulo"
+	PlacementRendezvous = "rendezvous"
+)
+
+var ErrCmdTimeout = errors.New("cmd timeout")
+
+var Conf = ClusterConf{Replicas: 1, Placement: PlacementModulo}
+
 func DefaultConfPath() string {
 	env := os.Getenv("S4_CONF_PATH")
 	if env != "" {
@@ -62,34 +254,21 @@ type WarnResult struct {
 }
 
 func Warn(format string, args ...interface{}) *WarnResult {
+	return WarnContext(context.Background(), format, args...)
+}
+
+func WarnContext(ctx context.Context, format string, args ...interface{}) *WarnResult {
+	return WarnEnvContext(ctx, nil, format, args...)
+}
+
+func WarnEnvContext(ctx context.Context, env []string, format string, args ...interface{}) *WarnResult {
 	str := fmt.Sprintf(format, args...)
 	str = fmt.Sprintf("set -eou pipefail; %s", str)
-	cmd := exec.Command("bash", "-c", str)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	result := make(chan *WarnResult)
-	go func() {
-		// defer func() {}()
-		err := cmd.Run()
-		result <- &WarnResult{
-			strings.TrimRight(stdout.String(), "\n"),
-			strings.TrimRight(stderr.String(), "\n"),
-			err,
-		}
-	}()
-	select {
-	case r := <-result:
-		return r
-	case <-time.After(Timeout):
-		_ = cmd.Process.Kill()
-		return &WarnResult{
-			"",
-			"",
-			errors.New("cmd timeout"),
-		}
+	if len(env) > 0 {
+		env = append(os.Environ(), env...)
 	}
+	stdout, stderr, err := run(ctx, env, nil, nil, nil, str)
+	return &WarnResult{stdout, stderr, err}
 }
 
 type WarnResultTempdir struct {
@@ -99,80 +278,493 @@ type WarnResultTempdir struct {
 	Tempdir string
 }
 
+type CmdOpts struct {
+	Stdin   io.Reader
+	Stdout  io.Writer
+	Stderr  io.Writer
+	Tempdir string
+	Limits  Limits
+	Inputs  []string
+	Env     []string
+	Files   map[string]string
+}
+
 func WarnTempdir(format string, args ...interface{}) *WarnResultTempdir {
-	tempdir := panic2(os.MkdirTemp("_tempdirs", "")).(string)
+	return WarnTempdirContext(context.Background(), CmdOpts{}, format, args...)
+}
+
+func WarnTempdirStreamIn(stdin io.Reader, format string, args ...interface{}) *WarnResultTempdir {
+	return WarnTempdirContext(context.Background(), CmdOpts{Stdin: stdin}, format, args...)
+}
+
+func WarnTempdirContext(ctx context.Context, opts CmdOpts, format string, args ...interface{}) *WarnResultTempdir {
+	tempdir := opts.Tempdir
+	if tempdir == "" {
+		tempdir = panic2(os.MkdirTemp("_tempdirs", "")).(string)
+	}
+	for name, content := range opts.Files {
+		panic1(os.WriteFile(Join(tempdir, name), []byte(content), 0o644))
+	}
+	cg, err := newCgroup(opts.Limits)
+	if err != nil {
+		panic1(os.RemoveAll(tempdir))
+		return &WarnResultTempdir{"", "", err, ""}
+	}
+	defer cg.remove()
+	if opts.Limits.Disk > 0 {
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		defer cancel(nil)
+		go watchDisk(ctx, cancel, tempdir, opts.Limits.Disk)
+	}
 	str := fmt.Sprintf(format, args...)
-	str = fmt.Sprintf("set -eou pipefail; cd %s; %s", tempdir, str)
-	cmd := exec.Command("bash", "-c", str)
-	var stdout bytes.Buffer
-	cmd.Stdout = &stdout
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-	result := make(chan *WarnResultTempdir)
-	go func() {
-		// defer func() {}()
-		err := cmd.Run()
-		result <- &WarnResultTempdir{
-			strings.TrimRight(stdout.String(), "\n"),
-			strings.TrimRight(stderr.String(), "\n"),
-			err,
-			tempdir,
+	var env []string
+	if len(opts.Env) > 0 || Sandbox != nil {
+		env = append(os.Environ(), opts.Env...)
+	}
+	if Sandbox != nil {
+		root := tempdir + ".root"
+		panic1(os.Mkdir(root, os.ModePerm))
+		defer func() { _ = os.Remove(root) }()
+		absRoot := panic2(filepath.Abs(root)).(string)
+		absTempdir := panic2(filepath.Abs(tempdir)).(string)
+		if os.Geteuid() == 0 {
+			panic1(os.Chown(tempdir, sandboxUID, sandboxUID))
 		}
-	}()
-	select {
-	case r := <-result:
-		return r
-	case <-time.After(Timeout):
-		_ = cmd.Process.Kill()
+		var inner string
+		str, inner = Sandbox.wrap(opts.Limits.prefix(cg), absRoot, absTempdir, opts.Inputs, str)
+		env = append(env, "S4_CMD="+inner)
+	} else {
+		str = fmt.Sprintf("set -eou pipefail; %scd %s; %s", opts.Limits.prefix(cg), tempdir, str)
+	}
+	stdoutStr, stderrStr, err := run(ctx, env, opts.Stdin, opts.Stdout, opts.Stderr, str)
+	if err != nil && (errors.Is(err, ErrCmdTimeout) || errors.Is(err, context.Canceled)) {
 		panic1(os.RemoveAll(tempdir))
-		return &WarnResultTempdir{
-			"",
-			"",
-			errors.New("cmd timeout"),
-			"",
+		return &WarnResultTempdir{"", "", err, ""}
+	}
+	if err != nil && (cg.oomKilled() || (cg == nil && opts.Limits.Memory > 0 && AllocFailed(stderrStr))) {
+		err = ErrMemoryLimit
+	}
+	return &WarnResultTempdir{stdoutStr, stderrStr, err, tempdir}
+}
+
+type sandbox struct {
+	paths []string
+}
+
+var Sandbox *sandbox
+
+func InitSandbox(paths []string) error {
+	var existing []string
+	for _, p := range paths {
+		if _, err := os.Stat(p); err == nil {
+			existing = append(existing, p)
 		}
 	}
+	res := Warn("unshare --mount --pid --net --fork %s setpriv %s true", mapRootUser(), dropPrivileges())
+	if res.Err != nil {
+		return fmt.Errorf("unshare failed: %s %s", res.Err, res.Stderr)
+	}
+	Sandbox = &sandbox{existing}
+	return nil
 }
 
-func WarnTempdirStreamIn(stdin io.Reader, format string, args ...interface{}) *WarnResultTempdir {
-	tempdir := panic2(os.MkdirTemp("_tempdirs", "")).(string)
-	str := fmt.Sprintf(format, args...)
-	str = fmt.Sprintf("set -eou pipefail; cd %s; %s", tempdir, str)
-	cmd := exec.Command("bash", "-c", str)
+func mapRootUser() string {
+	if os.Geteuid() == 0 {
+		return ""
+	}
+	return "--map-root-user"
+}
+
+const sandboxUID = 65534
+
+func dropPrivileges() string {
+	flags := "--no-new-privs --inh-caps=-all --bounding-set=-all"
+	if os.Geteuid() == 0 {
+		flags = fmt.Sprintf("--reuid=%[1]d --regid=%[1]d --clear-groups %s", sandboxUID, flags)
+	}
+	return flags
+}
+
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (s *sandbox) wrap(prefix string, root string, tempdir string, inputs []string, str string) (string, string) {
+	setup := []string{
+		"set -eou pipefail",
+		"mount -t tmpfs tmpfs " + ShellQuote(root),
+		fmt.Sprintf("mkdir -p %[1]s/proc %[1]s/tmp", ShellQuote(root)),
+		fmt.Sprintf("mount -t proc proc %s/proc", ShellQuote(root)),
+		fmt.Sprintf("mount -t tmpfs tmpfs %s/tmp", ShellQuote(root)),
+	}
+	bind := func(src string, file bool, ro bool) {
+		dst := ShellQuote(root + src)
+		if file {
+			setup = append(setup, fmt.Sprintf("mkdir -p %s && touch %s", ShellQuote(root+path.Dir(src)), dst))
+		} else {
+			setup = append(setup, "mkdir -p "+dst)
+		}
+		setup = append(setup, fmt.Sprintf("mount --rbind %s %s", ShellQuote(src), dst))
+		if ro {
+			setup = append(setup, "mount -o remount,bind,ro "+dst)
+		}
+	}
+	for _, p := range s.paths {
+		bind(p, false, true)
+	}
+	for _, dev := range []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"} {
+		bind(dev, true, false)
+	}
+	bind(tempdir, false, false)
+	for _, input := range inputs {
+		bind(input, true, true)
+	}
+	setup = append(setup,
+		fmt.Sprintf("mkdir %s/.oldroot", ShellQuote(root)),
+		fmt.Sprintf("cd %s", ShellQuote(root)),
+		"pivot_root . .oldroot",
+		"cd /",
+		"umount -l /.oldroot",
+		"rmdir /.oldroot",
+		fmt.Sprintf(`exec setpriv %s env -u S4_CMD bash -c "$S4_CMD"`, dropPrivileges()),
+	)
+	outer := fmt.Sprintf("set -eou pipefail; %sexec unshare --mount --pid --net --fork --kill-child %s bash -c %s", prefix, mapRootUser(), ShellQuote(strings.Join(setup, "; ")))
+	inner := fmt.Sprintf("set -eou pipefail; cd %s; %s", ShellQuote(tempdir), str)
+	return outer, inner
+}
+
+type Limits struct {
+	Memory    int64 `json:"memory"`
+	CPUWeight int   `json:"cpu_weight"`
+	Pids      int   `json:"pids"`
+	Disk      int64 `json:"disk"`
+}
+
+var (
+	ErrMemoryLimit = errors.New("killed: memory limit")
+	ErrDiskLimit   = errors.New("killed: disk limit")
+	CgroupRoot     string
+)
+
+func InitCgroup(root string) error {
+	err := os.MkdirAll(root, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(Join(root, "cgroup.subtree_control"), []byte("+memory +cpu +pids"), 0o644)
+	if err != nil {
+		return err
+	}
+	CgroupRoot = root
+	return nil
+}
+
+type cgroup struct {
+	path string
+}
+
+func newCgroup(limits Limits) (*cgroup, error) {
+	if CgroupRoot == "" || (limits.Memory == 0 && limits.CPUWeight == 0 && limits.Pids == 0) {
+		return nil, nil
+	}
+	cg := &cgroup{Join(CgroupRoot, uuid.Must(uuid.NewV4()).String())}
+	err := os.Mkdir(cg.path, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	if limits.Memory > 0 {
+		files["memory.max"] = fmt.Sprint(limits.Memory)
+	}
+	if limits.CPUWeight > 0 {
+		files["cpu.weight"] = fmt.Sprint(limits.CPUWeight)
+	}
+	if limits.Pids > 0 {
+		files["pids.max"] = fmt.Sprint(limits.Pids)
+	}
+	for name, val := range files {
+		err := os.WriteFile(Join(cg.path, name), []byte(val), 0o644)
+		if err != nil {
+			cg.remove()
+			return nil, err
+		}
+	}
+	if limits.Memory > 0 {
+		_ = os.WriteFile(Join(cg.path, "memory.swap.max"), []byte("0"), 0o644)
+	}
+	return cg, nil
+}
+
+func (cg *cgroup) oomKilled() bool {
+	if cg == nil {
+		return false
+	}
+	bytes, err := os.ReadFile(Join(cg.path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(bytes), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 2 && parts[0] == "oom_kill" && parts[1] != "0" {
+			return true
+		}
+	}
+	return false
+}
+
+var allocFailures = []string{"cannot allocate memory", "out of memory", "memory exhausted", "memoryerror", "bad_alloc", "failed to allocate"}
+
+func AllocFailed(stderr string) bool {
+	stderr = strings.ToLower(stderr)
+	for _, failure := range allocFailures {
+		if strings.Contains(stderr, failure) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cg *cgroup) remove() {
+	if cg == nil {
+		return
+	}
+	_ = os.WriteFile(Join(cg.path, "cgroup.kill"), []byte("1"), 0o644)
+	for i := 0; i < 50; i++ {
+		err := os.Remove(cg.path)
+		if err == nil || errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	Logger.Printf("failed to remove cgroup: %s\n", cg.path)
+}
+
+func (limits Limits) prefix(cg *cgroup) string {
+	if cg != nil {
+		return fmt.Sprintf("echo $$ > %s; ", Join(cg.path, "cgroup.procs"))
+	}
+	var prefix string
+	if limits.Memory > 0 {
+		prefix += fmt.Sprintf("ulimit -v %d; ", limits.Memory/1024)
+	}
+	if limits.Pids > 0 {
+		prefix += fmt.Sprintf("ulimit -u %d; ", limits.Pids)
+	}
+	return prefix
+}
+
+func watchDisk(ctx context.Context, cancel context.CancelCauseFunc, dir string, limit int64) {
+	// defer func() {}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		var size int64
+		_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if size > limit {
+			cancel(ErrDiskLimit)
+			return
+		}
+	}
+}
+
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	unit := int64(1)
+	num := s
+	if mult, ok := units[strings.ToUpper(s)[len(s)-1]]; ok {
+		unit = mult
+		num = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size: %s", s)
+	}
+	return n * unit, nil
+}
+
+type Partitioner struct {
+	Field      int
+	Sep        string
+	Partitions int
+}
+
+func ParsePartitionBy(spec string, partitions int) (*Partitioner, error) {
+	p := &Partitioner{Sep: ",", Partitions: partitions}
+	if partitions < 1 {
+		return nil, fmt.Errorf("partitions must be positive, got: %d", partitions)
+	}
+	if spec == "line" {
+		return p, nil
+	}
+	rest := spec
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "field:"):
+			rest = rest[len("field:"):]
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				end = len(rest)
+			}
+			field, err := strconv.Atoi(rest[:end])
+			if err != nil || field < 1 {
+				return nil, fmt.Errorf("bad partition-by field, want 1 or more: %s", spec)
+			}
+			p.Field = field
+			rest = rest[end:]
+		case strings.HasPrefix(rest, `sep:\t`):
+			p.Sep = "\t"
+			rest = rest[len(`sep:\t`):]
+		case strings.HasPrefix(rest, "sep:") && len(rest) > len("sep:"):
+			p.Sep = rest[len("sep:") : len("sep:")+1]
+			rest = rest[len("sep:")+1:]
+		default:
+			return nil, fmt.Errorf("bad partition-by, want line or field:N[,sep:C]: %s", spec)
+		}
+		rest = strings.TrimPrefix(rest, ",")
+	}
+	if p.Field == 0 {
+		return nil, fmt.Errorf("bad partition-by, missing field: %s", spec)
+	}
+	return p, nil
+}
+
+func (p *Partitioner) Partition(line []byte) int {
+	if p.Field > 0 {
+		fields := bytes.SplitN(line, []byte(p.Sep), p.Field+1)
+		line = nil
+		if len(fields) >= p.Field {
+			line = fields[p.Field-1]
+		}
+	}
+	return int(xxhash.Sum64(line) % uint64(p.Partitions))
+}
+
+func (p *Partitioner) PartitionFile(src string, dir string) ([]string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = in.Close() }()
+	outs := make(map[int]*os.File)
+	writers := make(map[int]*bufio.Writer)
+	defer func() {
+		for _, out := range outs {
+			_ = out.Close()
+		}
+	}()
+	reader := bufio.NewReaderSize(in, 1024*1024)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			var full []byte
+			full, err = reader.ReadBytes('\n')
+			line = append(append([]byte{}, line...), full...)
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) > 0 {
+			partition := p.Partition(bytes.TrimSuffix(line, []byte("\n")))
+			writer, ok := writers[partition]
+			if !ok {
+				out, err := os.Create(Join(dir, fmt.Sprintf("%05d", partition)))
+				if err != nil {
+					return nil, err
+				}
+				outs[partition] = out
+				writer = bufio.NewWriterSize(out, 64*1024)
+				writers[partition] = writer
+			}
+			_, err := writer.Write(line)
+			if err == nil && line[len(line)-1] != '\n' {
+				err = writer.WriteByte('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	var names []string
+	for partition, writer := range writers {
+		err := writer.Flush()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, fmt.Sprintf("%05d", partition))
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func HandlerTimeout(timeout time.Duration) time.Duration {
+	return timeout*2 + 15*time.Second
+}
+
+func run(ctx context.Context, env []string, stdin io.Reader, stdoutTee io.Writer, stderrTee io.Writer, str string) (string, string, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "bash", "-c", str)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = ioTimeout
+	cmd.Env = env
 	cmd.Stdin = stdin
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
+	if stdoutTee != nil {
+		cmd.Stdout = io.MultiWriter(&stdout, stdoutTee)
+	}
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	result := make(chan *WarnResultTempdir)
-	go func() {
-		// defer func() {}()
-		err := cmd.Run()
-		result <- &WarnResultTempdir{
-			strings.TrimRight(stdout.String(), "\n"),
-			strings.TrimRight(stderr.String(), "\n"),
-			err,
-			tempdir,
-		}
-	}()
-	select {
-	case r := <-result:
-		return r
-	case <-time.After(Timeout):
-		_ = cmd.Process.Kill()
-		panic1(os.RemoveAll(tempdir))
-		return &WarnResultTempdir{
-			"",
-			"",
-			errors.New("cmd timeout"),
-			"",
-		}
+	if stderrTee != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, stderrTee)
+	}
+	err := cmd.Run()
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return "", "", ErrCmdTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		return "", "", context.Cause(ctx)
 	}
+	return strings.TrimRight(stdout.String(), "\n"), strings.TrimRight(stderr.String(), "\n"), err
 }
 
 type Server struct {
 	Address string
 	Port    string
+	Name    string
+	Weight  int
+}
+
+func (s Server) HostPort() string {
+	return net.JoinHostPort(s.Address, s.Port)
+}
+
+func (s Server) weight() uint64 {
+	if s.Weight < 1 {
+		return 1
+	}
+	return uint64(s.Weight)
 }
 
 func GetServers(confPath string) ([]Server, error) {
@@ -186,29 +778,99 @@ func GetServers(confPath string) ([]Server, error) {
 	if err != nil {
 		return []Server{}, err
 	}
+	conf := ClusterConf{Replicas: 1, Placement: PlacementModulo}
+	var directives []string
+	var names []string
+	seen := make(map[string]bool)
 	for _, line := range lines {
-		if strings.Trim(line, " ") == "" {
+		if strings.Trim(line, " ") == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !strings.Contains(fields[0], ":") {
+			name := fields[0]
+			if name == "partition" && len(fields) > 1 {
+				name += " " + fields[1]
+			}
+			if seen[name] {
+				return []Server{}, fmt.Errorf("duplicate config line: %s", line)
+			}
+			seen[name] = true
+			err := parseDirective(&conf, fields)
+			if err != nil {
+				return []Server{}, err
+			}
+			directives = append(directives, strings.Join(fields, " "))
 			continue
 		}
-		parts := strings.Split(line, ":")
-		if len(parts) != 2 {
+		names = append(names, strings.Join(fields, " "))
+		address, port, err := net.SplitHostPort(fields[0])
+		if err != nil || address == "" || port == "" {
 			return []Server{}, fmt.Errorf("bad config line: %s", line)
 		}
-		server := Server{parts[0], parts[1]}
-		for _, address := range localAddresses {
-			if server.Address == address {
-				server.Address = "0.0.0.0"
-				break
+		server := Server{address, port, fields[0], 1}
+		for _, field := range fields[1:] {
+			weight, ok := strings.CutPrefix(field, "weight=")
+			server.Weight, err = strconv.Atoi(weight)
+			if !ok || err != nil || server.Weight < 1 {
+				return []Server{}, fmt.Errorf("bad config line, expected: address:port [weight=N]: %s", line)
 			}
 		}
+		if isLocalAddress(server.Address, localAddresses) {
+			server.Address = "0.0.0.0"
+		}
 		servers = append(servers, server)
 	}
 	if len(servers) == 0 {
 		return []Server{}, fmt.Errorf("empty config file")
 	}
+	if conf.Replicas > len(servers) {
+		return []Server{}, fmt.Errorf("replicas %d exceeds number of servers %d", conf.Replicas, len(servers))
+	}
+	sort.Strings(directives)
+	conf.Hash = fmt.Sprintf("%016x", hash(strings.Join(append(directives, names...), "\n")))
+	Conf = conf
 	return servers, nil
 }
 
+func parseDirective(conf *ClusterConf, fields []string) error {
+	line := strings.Join(fields, " ")
+	switch fields[0] {
+	case "replicas":
+		if len(fields) != 2 {
+			return fmt.Errorf("bad config line: %s", line)
+		}
+		replicas, err := strconv.Atoi(fields[1])
+		if err != nil || replicas < 1 {
+			return fmt.Errorf("bad replicas: %s", line)
+		}
+		conf.Replicas = replicas
+	case "placement":
+		if len(fields) != 2 || (fields[1] != PlacementModulo && fields[1] != PlacementRendezvous) {
+			return fmt.Errorf("bad placement, expected %s or %s: %s", PlacementModulo, PlacementRendezvous, line)
+		}
+		conf.Placement = fields[1]
+	case "partition":
+		if len(fields) < 3 || len(fields) > 4 || (len(fields) == 4 && fields[3] != "numeric") {
+			return fmt.Errorf("bad partition, expected: partition BUCKET REGEX [numeric]: %s", line)
+		}
+		re, err := regexp.Compile(fields[2])
+		if err != nil {
+			return fmt.Errorf("bad partition regex: %s: %w", line, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("bad partition regex, needs a capture group: %s", line)
+		}
+		if conf.Partitions == nil {
+			conf.Partitions = make(map[string]*PartitionRule)
+		}
+		conf.Partitions[fields[1]] = &PartitionRule{re, len(fields) == 4}
+	default:
+		return fmt.Errorf("bad config line: %s", line)
+	}
+	return nil
+}
+
 func localAddresses() ([]string, error) {
 	vals := []string{"0.0.0.0", "localhost", "127.0.0.1"}
 	ifaces, err := net.Interfaces()
@@ -227,6 +889,47 @@ func localAddresses() ([]string, error) {
 	return vals, nil
 }
 
+func isLocalAddress(address string, localAddresses []string) bool {
+	ip := net.ParseIP(address)
+	for _, local := range localAddresses {
+		if address == local {
+			return true
+		}
+		if ip != nil && ip.Equal(net.ParseIP(local)) {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvesLocal(address string, localAddresses []string) bool {
+	if isLocalAddress(address, localAddresses) {
+		return true
+	}
+	if net.ParseIP(address) != nil {
+		return false
+	}
+	ips, err := net.LookupHost(address)
+	if err != nil {
+		Logger.Printf("failed to resolve conf address %s: %s\n", address, err)
+		return false
+	}
+	for _, ip := range ips {
+		if isLocalAddress(ip, localAddresses) {
+			return true
+		}
+	}
+	return false
+}
+
+func RemoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 type HTTPResult struct {
 	StatusCode int
 	Body       []byte
@@ -234,36 +937,49 @@ type HTTPResult struct {
 }
 
 func Post(url, contentType string, body io.Reader) *HTTPResult {
-	var err error
-	var resp *http.Response
-	var respBody []byte
-	resp, err = client.Post(url, contentType, body)
-	if err == nil {
-
-		respBody, err = io.ReadAll(resp.Body)
-		_ = resp.Body.Close()
-		if err != nil {
-			return &HTTPResult{-1, []byte{}, err}
-		}
-		return &HTTPResult{resp.StatusCode, respBody, nil}
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return &HTTPResult{-1, []byte{}, err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	return do(req)
+}
+
+func PostTimeout(url, contentType string, body io.Reader, timeout time.Duration) *HTTPResult {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return &HTTPResult{-1, []byte{}, err}
 	}
-	return &HTTPResult{-1, []byte{}, err}
+	req.Header.Set("Content-Type", contentType)
+	return doClient(&http.Client{Timeout: timeout}, req)
 }
 
 func Get(url string) *HTTPResult {
-	var err error
-	var resp *http.Response
-	var respBody []byte
-	resp, err = client.Get(url)
-	if err == nil {
-		respBody, err = io.ReadAll(resp.Body)
-		_ = resp.Body.Close()
-		if err != nil {
-			return &HTTPResult{-1, []byte{}, err}
-		}
-		return &HTTPResult{resp.StatusCode, respBody, nil}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return &HTTPResult{-1, []byte{}, err}
+	}
+	return do(req)
+}
+
+func do(req *http.Request) *HTTPResult {
+	return doClient(&client, req)
+}
+
+func doClient(client *http.Client, req *http.Request) *HTTPResult {
+	if Conf.Hash != "" {
+		req.Header.Set(ConfHashHeader, Conf.Hash)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return &HTTPResult{-1, []byte{}, err}
 	}
-	return &HTTPResult{-1, []byte{}, err}
+	respBody, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return &HTTPResult{-1, []byte{}, err}
+	}
+	return &HTTPResult{resp.StatusCode, respBody, nil}
 }
 
 type rwcCallback struct {
@@ -307,7 +1023,20 @@ func OnThisServer(key string, this Server, servers []Server) (bool, error) {
 	if !strings.HasPrefix(key, "s4://") {
 		return false, fmt.Errorf("missing s4:// prefix: %s", key)
 	}
-	picked, err := PickServer(key, servers)
+	picked, err := PickServers(key, servers)
+	if err != nil {
+		return false, err
+	}
+	for _, server := range picked {
+		if server.Address == this.Address && server.Port == this.Port {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func IsPrimary(key string, this Server, servers []Server, down []int) (bool, error) {
+	picked, err := PickPrimary(key, servers, down)
 	if err != nil {
 		return false, err
 	}
@@ -315,22 +1044,143 @@ func OnThisServer(key string, this Server, servers []Server) (bool, error) {
 }
 
 func PickServer(key string, servers []Server) (Server, error) {
+	picked, err := PickServers(key, servers)
+	if err != nil {
+		return Server{}, err
+	}
+	return picked[0], nil
+}
+
+func PickServers(key string, servers []Server) ([]Server, error) {
+	return PickLive(key, servers, nil)
+}
+
+func PickPrimary(key string, servers []Server, down []int) (Server, error) {
+	live, err := PickLive(key, servers, down)
+	if err != nil {
+		return Server{}, err
+	}
+	return live[0], nil
+}
+
+func PickLive(key string, servers []Server, down []int) ([]Server, error) {
+	indices, err := pickIndices(key, servers)
+	if err != nil {
+		return []Server{}, err
+	}
+	var live []Server
+	for _, i := range indices {
+		if !ContainsInt(down, i) {
+			live = append(live, servers[i])
+		}
+	}
+	if len(live) == 0 {
+		return []Server{}, fmt.Errorf("all replicas down for key: %s", key)
+	}
+	return live, nil
+}
+
+type Placement struct {
+	Key     string
+	Prefix  string
+	Numeric bool
+	Value   uint64
+	Servers []Server
+}
+
+func Where(key string, servers []Server) (*Placement, error) {
+	prefix, numeric, val := placementValue(key)
+	indices, err := pickIndices(key, servers)
+	if err != nil {
+		return nil, err
+	}
+	var picked []Server
+	for _, i := range indices {
+		picked = append(picked, servers[i])
+	}
+	return &Placement{key, prefix, numeric, val, picked}, nil
+}
+
+func placementValue(key string) (string, bool, uint64) {
+	prefix, _, numeric := splitKey(key)
+	if !numeric {
+		return prefix, false, hash(prefix)
+	}
+	tmp, _ := strconv.Atoi(prefix)
+	return prefix, true, uint64(tmp)
+}
+
+func pickIndices(key string, servers []Server) ([]int, error) {
 	if strings.HasSuffix(key, "/") {
-		return Server{}, fmt.Errorf("needed key, got directory: %s", key)
+		return []int{}, fmt.Errorf("needed key, got directory: %s", key)
 	}
 	if !strings.HasPrefix(key, "s4://") {
-		return Server{}, fmt.Errorf("missing s4:// prefix: %s", key)
+		return []int{}, fmt.Errorf("missing s4:// prefix: %s", key)
 	}
-	prefix := KeyPrefix(key)
-	tmp, err := strconv.Atoi(prefix)
-	var val uint64
-	if err != nil {
-		val = hash(prefix)
+	prefix, numeric, val := placementValue(key)
+	if Conf.Placement == PlacementRendezvous {
+		if numeric {
+			prefix = fmt.Sprint(val)
+		}
+		return rendezvousIndices(prefix, servers), nil
+	}
+	index := int(val % uint64(len(servers)))
+	if !numeric && weighted(servers) {
+		index = weightedIndex(val, servers)
+	}
+	var indices []int
+	for i := 0; i < Conf.Replicas && i < len(servers); i++ {
+		indices = append(indices, (index+i)%len(servers))
+	}
+	return indices, nil
+}
+
+func weighted(servers []Server) bool {
+	for _, server := range servers {
+		if server.weight() != 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func weightedIndex(val uint64, servers []Server) int {
+	var total uint64
+	for _, server := range servers {
+		total += server.weight()
+	}
+	val = val % total
+	for i, server := range servers {
+		if val < server.weight() {
+			return i
+		}
+		val -= server.weight()
+	}
+	panic("unreachable")
+}
+
+func rendezvousIndices(prefix string, servers []Server) []int {
+	scores := make([]uint64, len(servers))
+	weightedScores := make([]float64, len(servers))
+	indices := make([]int, len(servers))
+	for i, server := range servers {
+		scores[i] = hash(prefix + "\x00" + server.Name)
+		weightedScores[i] = float64(server.weight()) / -math.Log((float64(scores[i])+0.5)/math.Exp2(64))
+		indices[i] = i
+	}
+	if weighted(servers) {
+		sort.SliceStable(indices, func(a, b int) bool {
+			return weightedScores[indices[a]] > weightedScores[indices[b]]
+		})
 	} else {
-		val = uint64(tmp)
+		sort.SliceStable(indices, func(a, b int) bool {
+			return scores[indices[a]] > scores[indices[b]]
+		})
+	}
+	if Conf.Replicas < len(indices) {
+		indices = indices[:Conf.Replicas]
 	}
-	index := val % uint64(len(servers))
-	return servers[index], nil
+	return indices
 }
 
 func isDigits(str string) bool {
@@ -339,33 +1189,54 @@ func isDigits(str string) bool {
 }
 
 func KeyPrefix(key string) string {
-	key = Last(strings.Split(key, "/"))
-	prefix := strings.Split(key, "_")[0]
-	if !isDigits(prefix) {
-		prefix = key
-	}
+	prefix, _, _ := splitKey(key)
 	return prefix
 }
 
-func keySuffix(key string) (string, bool) {
-	if !isDigits(KeyPrefix(key)) {
-		return "", false
+func partitionRule(key string) *PartitionRule {
+	if !strings.HasPrefix(key, "s4://") {
+		return nil
+	}
+	bucket := strings.SplitN(strings.SplitN(key, "s4://", 2)[1], "/", 2)[0]
+	return Conf.Partitions[bucket]
+}
+
+func splitRule(key string) (string, string, bool, bool) {
+	rule := partitionRule(key)
+	if rule == nil {
+		return "", "", false, false
+	}
+	name := Last(strings.Split(key, "/"))
+	match := rule.Regexp.FindStringSubmatchIndex(name)
+	if match == nil || match[2] == -1 {
+		return "", "", false, false
+	}
+	prefix := name[match[2]:match[3]]
+	return prefix, name[match[3]:], rule.Numeric && isDigits(prefix), true
+}
+
+func splitKey(key string) (string, string, bool) {
+	prefix, suffix, numeric, ok := splitRule(key)
+	if ok {
+		return prefix, suffix, numeric
+	}
+	name := Last(strings.Split(key, "/"))
+	parts := strings.SplitN(name, "_", 2)
+	if !isDigits(parts[0]) {
+		return name, "", false
 	}
-	part := Last(strings.Split(key, "/"))
-	parts := strings.SplitN(part, "_", 2)
 	if len(parts) == 2 {
-		return parts[1], true
+		return parts[0], "_" + parts[1], true
 	}
-	return "", false
+	return parts[0], "", true
 }
 
 func Suffix(keys []string) string {
 	suffixes := make(map[string]string)
 	var suffix string
-	var ok bool
 	for _, key := range keys {
-		suffix, ok = keySuffix(key)
-		if !ok {
+		_, suffix, _ = splitKey(key)
+		if suffix == "" {
 			return ""
 		}
 		suffixes[suffix] = ""
@@ -376,7 +1247,21 @@ func Suffix(keys []string) string {
 	if len(suffixes) != 1 {
 		return ""
 	}
-	return fmt.Sprintf("_%s", suffix)
+	return suffix
+}
+
+func GroupName(prefix string, keys []string) string {
+	var names []string
+	for _, key := range keys {
+		if _, _, _, ok := splitRule(key); ok {
+			names = append(names, Last(strings.Split(key, "/")))
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return names[0]
+	}
+	return prefix + Suffix(keys)
 }
 
 func NewTempPath(dir string) string {
@@ -502,7 +1387,12 @@ func Recv(w io.Writer, port chan<- string) (string, error) {
 			fail <- err
 			return
 		}
-		port <- Last(strings.Split(li.Addr().String(), ":"))
+		_, p, err := net.SplitHostPort(li.Addr().String())
+		if err != nil {
+			fail <- err
+			return
+		}
+		port <- p
 		conn, err := li.Accept()
 		if err != nil {
 			fail <- err
@@ -561,7 +1451,7 @@ func Send(r io.Reader, addr string, port string) (string, error) {
 	go func() {
 		// defer func() {}()
 		h := xxhash.New()
-		dst := fmt.Sprintf("%s:%s", addr, port)
+		dst := net.JoinHostPort(addr, port)
 		var conn net.Conn
 		err := Retry(func() error {
 			var err error
@@ -627,13 +1517,20 @@ func (h *RootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(500)
 			panic2(fmt.Fprintf(w, "%s\n", err))
 			seconds := fmt.Sprintf("%.5f", time.Since(start).Seconds())
-			Logger.Println(500, r.Method, r.URL.Path+"?"+r.URL.RawQuery, strings.Split(r.RemoteAddr, ":")[0], seconds)
+			Logger.Println(500, r.Method, r.URL.Path+"?"+r.URL.RawQuery, RemoteHost(r), seconds)
 		}
 	}()
 	wo := &responseObserver{w, 200}
-	h.Handler(wo, r, h.This, h.Servers)
+	wo.Header().Set(ConfHashHeader, Conf.Hash)
+	clientHash := r.Header.Get(ConfHashHeader)
+	if clientHash != "" && clientHash != Conf.Hash && r.URL.Path != "/health" {
+		wo.WriteHeader(412)
+		panic2(fmt.Fprintf(wo, "conf mismatch: client conf hash %s != server %s conf hash %s, the client and every server need the same conf\n", clientHash, h.This.Name, Conf.Hash))
+	} else {
+		h.Handler(wo, r, h.This, h.Servers)
+	}
 	seconds := fmt.Sprintf("%.5f", time.Since(start).Seconds())
-	Logger.Println(wo.Status, r.Method, r.URL.Path+"?"+r.URL.RawQuery, strings.Split(r.RemoteAddr, ":")[0], seconds)
+	Logger.Println(wo.Status, r.Method, r.URL.Path+"?"+r.URL.RawQuery, RemoteHost(r), seconds)
 }
 
 func Dir(pth string) string {
@@ -679,6 +1576,15 @@ func Contains(parts []string, part string) bool {
 	return false
 }
 
+func ContainsInt(vals []int, val int) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
 func Await(wg *sync.WaitGroup) <-chan error {
 	done := make(chan error)
 	go func() {
@@ -727,6 +1633,17 @@ func With(pool *semaphore.Weighted, fn func()) {
 	fn()
 }
 
+func WithContext(ctx context.Context, pool *semaphore.Weighted, fn func()) error {
+	defer func() {}() // linter
+	err := pool.Acquire(ctx, 1)
+	if err != nil {
+		return err
+	}
+	defer func() { pool.Release(1) }()
+	fn()
+	return nil
+}
+
 func QueryParam(r *http.Request, name string) string {
 	vals := r.URL.Query()[name]
 	assert(len(vals) == 1, "missing query parameter: %s", name)
@@ -746,24 +1663,21 @@ func QueryParamDefault(r *http.Request, name string, defaultVal string) string {
 }
 
 func ThisServer(port int, servers []Server) Server {
+	localAddresses := panic2(localAddresses()).([]string)
 	var this Server
-	if port == 0 {
-		count := 0
-		for _, server := range servers {
-			if server.Address == "0.0.0.0" {
-				this = server
-				count++
-			}
+	count := 0
+	for _, server := range servers {
+		if port != 0 && server.Port != fmt.Sprint(port) {
+			continue
+		}
+		if resolvesLocal(server.Address, localAddresses) {
+			this = server
+			count++
 		}
+	}
+	if port == 0 {
 		assert(count == 1, "unless -port is specified, conf should have exactly one entry per server address")
 	} else {
-		count := 0
-		for _, server := range servers {
-			if server.Address == "0.0.0.0" && server.Port == fmt.Sprint(port) {
-				this = server
-				count++
-			}
-		}
 		assert(count == 1, "when -port is specified, conf should have exactly one entry per server (address, port)")
 	}
 	return this
@@ -2,6 +2,8 @@ package lib
 
 import (
 	"fmt"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -49,9 +51,9 @@ func TestHash(t *testing.T) {
 
 func TestPickServer(t *testing.T) {
 	servers := []Server{
-		{"a", "123"},
-		{"b", "123"},
-		{"c", "123"},
+		{"a", "123", "a:123", 1},
+		{"b", "123", "b:123", 1},
+		{"c", "123", "c:123", 1},
 	}
 	type test struct {
 		key    string
@@ -65,7 +67,364 @@ func TestPickServer(t *testing.T) {
 	for _, test := range tests {
 		server, _ := PickServer(test.key, servers)
 		if fmt.Sprintf("%s:%s", server.Address, server.Port) != test.output {
-			t.Errorf("got: %s, want: %s", server, test.output)
+			t.Errorf("got: %s, want: %s", server.HostPort(), test.output)
+		}
+	}
+}
+
+func TestPickServers(t *testing.T) {
+	servers := []Server{
+		{"a", "123", "a:123", 1},
+		{"b", "123", "b:123", 1},
+		{"c", "123", "c:123", 1},
+	}
+	Conf.Replicas = 2
+	defer func() { Conf.Replicas = 1 }()
+	type test struct {
+		key    string
+		output []string
+	}
+	tests := []test{
+		{"s4://bucket/a.txt", []string{"a:123", "b:123"}},
+		{"s4://bucket/d.txt", []string{"c:123", "a:123"}},
+		{"s4://bucket/f.txt", []string{"b:123", "c:123"}},
+	}
+	for _, test := range tests {
+		picked, _ := PickServers(test.key, servers)
+		var got []string
+		for _, server := range picked {
+			got = append(got, fmt.Sprintf("%s:%s", server.Address, server.Port))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.output) {
+			t.Errorf("got: %s, want: %s", got, test.output)
+		}
+		primary, _ := PickPrimary(test.key, servers, []int{0})
+		want := test.output[0]
+		if want == "a:123" {
+			want = test.output[1]
+		}
+		if fmt.Sprintf("%s:%s", primary.Address, primary.Port) != want {
+			t.Errorf("got: %s, want: %s", primary.HostPort(), want)
+		}
+	}
+	_, err := PickPrimary("s4://bucket/a.txt", servers, []int{0, 1})
+	if err == nil {
+		t.Errorf("expected error when all replicas are down")
+	}
+}
+
+func TestGetServersDirectives(t *testing.T) {
+	confPath := t.TempDir() + "/s4.conf"
+	err := os.WriteFile(confPath, []byte("# cluster\nreplicas 2\na:123\nb:123\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Conf.Replicas = 1 }()
+	servers, err := GetServers(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 || Conf.Replicas != 2 {
+		t.Errorf("got: %v %d", servers, Conf.Replicas)
+	}
+	err = os.WriteFile(confPath, []byte("replicas 3\na:123\nb:123\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = GetServers(confPath)
+	if err == nil {
+		t.Errorf("expected error when replicas exceeds servers")
+	}
+}
+
+func TestRendezvousMovesFewKeys(t *testing.T) {
+	var servers []Server
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("10.0.0.%d:8080", i)
+		servers = append(servers, Server{name, "8080", name, 1})
+	}
+	grown := append(append([]Server{}, servers...), Server{"10.0.0.10:8080", "8080", "10.0.0.10:8080", 1})
+	count := func() int {
+		moved := 0
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("s4://bucket/key%d.txt", i)
+			before, _ := PickServer(key, servers)
+			after, _ := PickServer(key, grown)
+			if before != after {
+				moved++
+			}
+		}
+		return moved
+	}
+	if moved := count(); moved < 500 {
+		t.Errorf("expected modulo placement to move most keys, moved: %d", moved)
+	}
+	Conf.Placement = PlacementRendezvous
+	defer func() { Conf.Placement = PlacementModulo }()
+	if moved := count(); moved > 150 {
+		t.Errorf("expected rendezvous placement to move ~1/11 of keys, moved: %d", moved)
+	}
+}
+
+func TestGetServersAddresses(t *testing.T) {
+	confPath := t.TempDir() + "/s4.conf"
+	err := os.WriteFile(confPath, []byte("[fd00::1]:8080\ns4-node-1.example:8080\n10.255.0.1:8080\n"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := GetServers(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"[fd00::1]:8080", "s4-node-1.example:8080", "10.255.0.1:8080"}
+	for i, server := range servers {
+		if server.HostPort() != want[i] || server.Name != want[i] {
+			t.Errorf("got: %s %s, want: %s", server.HostPort(), server.Name, want[i])
+		}
+	}
+	for _, line := range []string{"fd00::1:8080\n", "a:b:c\n", "a\n", ":8080\n"} {
+		err = os.WriteFile(confPath, []byte(line), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = GetServers(confPath)
+		if err == nil {
+			t.Errorf("expected error for conf line: %s", line)
+		}
+	}
+}
+
+func TestConfHash(t *testing.T) {
+	confPath := t.TempDir() + "/s4.conf"
+	confHash := func(conf string) string {
+		err := os.WriteFile(confPath, []byte(conf), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = GetServers(confPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return Conf.Hash
+	}
+	defer func() { Conf = ClusterConf{Replicas: 1, Placement: PlacementModulo} }()
+	base := confHash("replicas 2\nplacement rendezvous\na:123\nb:123\n")
+	if base != confHash("# comment\nplacement  rendezvous\n\na:123\nreplicas 2\nb:123   \n") {
+		t.Errorf("expected comments, whitespace, and directive order to be ignored")
+	}
+	if base == confHash("replicas 2\nplacement rendezvous\nb:123\na:123\n") {
+		t.Errorf("expected server order to change the hash")
+	}
+	if base == confHash("replicas 2\na:123\nb:123\n") {
+		t.Errorf("expected directives to change the hash")
+	}
+	for _, conf := range []string{
+		"replicas 2\nreplicas 1\na:123\nb:123\n",
+		"placement modulo\nplacement rendezvous\na:123\n",
+		"partition logs ^([a-z]+)-\npartition logs ^([0-9]+)-\na:123\n",
+	} {
+		err := os.WriteFile(confPath, []byte(conf), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = GetServers(confPath)
+		if err == nil || !strings.HasPrefix(err.Error(), "duplicate config line") {
+			t.Errorf("got: %v, want: duplicate config line", err)
+		}
+	}
+	if confHash("partition logs ^([a-z]+)-\npartition events ^([a-z]+)-\na:123\n") != confHash("partition events ^([a-z]+)-\npartition logs ^([a-z]+)-\na:123\n") {
+		t.Errorf("expected rules for different buckets in any order to hash the same")
+	}
+}
+
+func TestPartitionRules(t *testing.T) {
+	confPath := t.TempDir() + "/s4.conf"
+	conf := "partition events -part([0-9]+)\\.csv$ numeric\npartition logs ^([a-z]+)- \na:123\nb:123\nc:123\n"
+	err := os.WriteFile(confPath, []byte(conf), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Conf = ClusterConf{Replicas: 1, Placement: PlacementModulo} }()
+	servers, err := GetServers(confPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type test struct {
+		key     string
+		prefix  string
+		numeric bool
+		server  string
+	}
+	tests := []test{
+		{"s4://events/dir/events-2024-01-01-part7.csv", "7", true, "b"},
+		{"s4://events/dir/events-2024-01-02-part7.csv", "7", true, "b"},
+		{"s4://events/dir/events-2024-01-02-part9.csv", "9", true, "a"},
+		{"s4://events/dir/002_data.csv", "002", true, "c"},
+		{"s4://other/dir/events-2024-01-01-part7.csv", "events-2024-01-01-part7.csv", false, ""},
+		{"s4://logs/dir/web-01.txt", "web", false, ""},
+	}
+	for _, test := range tests {
+		placement, err := Where(test.key, servers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if placement.Prefix != test.prefix || placement.Numeric != test.numeric {
+			t.Errorf("got: %s %v, want: %s %v", placement.Prefix, placement.Numeric, test.prefix, test.numeric)
+		}
+		if test.server != "" && placement.Servers[0].Address != test.server {
+			t.Errorf("got: %s, want: %s", placement.Servers[0].Address, test.server)
+		}
+	}
+	if suffix := Suffix([]string{"s4://events/a/x-part7.csv", "s4://events/b/y-part7.csv"}); suffix != ".csv" {
+		t.Errorf("got: %s, want: .csv", suffix)
+	}
+	group := []string{"s4://events/dir/events-2024-01-02-part7.csv", "s4://events/dir/events-2024-01-01-part7.csv"}
+	if name := GroupName("7", group); name != "events-2024-01-01-part7.csv" {
+		t.Errorf("got: %s, want: events-2024-01-01-part7.csv", name)
+	}
+	in, _ := PickServer(group[0], servers)
+	out, _ := PickServer("s4://events/merged/"+GroupName("7", group), servers)
+	if in != out {
+		t.Errorf("got: %s, want: %s", out.Address, in.Address)
+	}
+	if name := GroupName("000", []string{"s4://bucket/a/000_x.csv", "s4://bucket/b/000_x.csv"}); name != "000_x.csv" {
+		t.Errorf("got: %s, want: 000_x.csv", name)
+	}
+	if suffix := Suffix([]string{"s4://bucket/a/000_x.csv", "s4://bucket/b/000_x.csv"}); suffix != "_x.csv" {
+		t.Errorf("got: %s, want: _x.csv", suffix)
+	}
+	if suffix := Suffix([]string{"s4://bucket/a/000_x.csv", "s4://bucket/b/000_y.csv"}); suffix != "" {
+		t.Errorf("got: %s, want: empty", suffix)
+	}
+	for _, line := range []string{"partition events [0-9]+\na:1\n", "partition events (\na:1\n", "partition events ([0-9]+) hashed\na:1\n"} {
+		err = os.WriteFile(confPath, []byte(line), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = GetServers(confPath)
+		if err == nil {
+			t.Errorf("expected error for conf: %s", line)
+		}
+	}
+}
+
+func TestWeightedPlacement(t *testing.T) {
+	servers := []Server{
+		{"a", "123", "a:123", 1},
+		{"b", "123", "b:123", 3},
+	}
+	share := func(format string) float64 {
+		count := 0
+		for i := 0; i < 4000; i++ {
+			server, _ := PickServer(fmt.Sprintf(format, i), servers)
+			if server.Address == "b" {
+				count++
+			}
+		}
+		return float64(count) / 4000
+	}
+	if got := share("s4://bucket/key%d.txt"); got < 0.7 || got > 0.8 {
+		t.Errorf("expected ~75%% of hashed keys on weight 3 server, got: %.3f", got)
+	}
+	if got := share("s4://bucket/%05d"); got != 0.5 {
+		t.Errorf("expected numeric keys to keep modulo placement, got: %.3f", got)
+	}
+	Conf.Placement = PlacementRendezvous
+	defer func() { Conf.Placement = PlacementModulo }()
+	if got := share("s4://bucket/key%d.txt"); got < 0.7 || got > 0.8 {
+		t.Errorf("expected ~75%% of rendezvous keys on weight 3 server, got: %.3f", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	type test struct {
+		input  string
+		output int64
+	}
+	tests := []test{
+		{"", 0},
+		{"100", 100},
+		{"4K", 4096},
+		{"4k", 4096},
+		{"10M", 10 << 20},
+		{"2G", 2 << 30},
+	}
+	for _, test := range tests {
+		output, err := ParseSize(test.input)
+		if err != nil || output != test.output {
+			t.Errorf("got: %d %v, want: %d", output, err, test.output)
+		}
+	}
+	for _, input := range []string{"G", "-1", "1.5G", "10X"} {
+		if _, err := ParseSize(input); err == nil {
+			t.Errorf("expected error for: %s", input)
+		}
+	}
+}
+
+func TestParsePartitionBy(t *testing.T) {
+	type test struct {
+		input string
+		field int
+		sep   string
+	}
+	tests := []test{
+		{"line", 0, ","},
+		{"field:2", 2, ","},
+		{"field:2,sep:,", 2, ","},
+		{"sep:|,field:3", 3, "|"},
+		{`field:1,sep:\t`, 1, "\t"},
+	}
+	for _, test := range tests {
+		p, err := ParsePartitionBy(test.input, 16)
+		if err != nil || p.Field != test.field || p.Sep != test.sep {
+			t.Errorf("got: %v %v, want: %d %q", p, err, test.field, test.sep)
+		}
+	}
+	for _, input := range []string{"", "field:0", "field:x", "sep:,", "col:1"} {
+		if _, err := ParsePartitionBy(input, 16); err == nil {
+			t.Errorf("expected error for: %s", input)
+		}
+	}
+	if _, err := ParsePartitionBy("line", 0); err == nil {
+		t.Errorf("expected error for zero partitions")
+	}
+}
+
+func TestPartition(t *testing.T) {
+	p, err := ParsePartitionBy("field:2,sep:,", 256)
+	if err != nil {
+		t.Errorf("got: %v, want: nil", err)
+		return
+	}
+	a := p.Partition([]byte("1,key,x"))
+	b := p.Partition([]byte("2,key,y"))
+	if a != b {
+		t.Errorf("got: %d %d, want: equal", a, b)
+	}
+	if a < 0 || a >= 256 {
+		t.Errorf("got: %d, want: 0-255", a)
+	}
+}
+
+func TestAllocFailed(t *testing.T) {
+	type test struct {
+		stderr string
+		failed bool
+	}
+	tests := []test{
+		{"bash: fork: Cannot allocate memory\n", true},
+		{"Traceback (most recent call last):\nMemoryError\n", true},
+		{"terminate called after throwing an instance of 'std::bad_alloc'\n", true},
+		{"sort: memory exhausted\n", true},
+		{"fatal error: runtime: out of memory\n", true},
+		{"grep: foo: No such file or directory\n", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		failed := AllocFailed(test.stderr)
+		if failed != test.failed {
+			t.Errorf("got: %v, want: %v, stderr: %q", failed, test.failed, test.stderr)
 		}
 	}
 }
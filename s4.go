@@ -6,12 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/cespare/xxhash"
+	"github.com/gofrs/uuid"
 	"github.com/nathants/s4/lib"
 )
 
@@ -24,7 +30,7 @@ func List(prefix string, recursive bool, servers []lib.Server) ([][]string, erro
 	for _, server := range servers {
 		go func(server lib.Server) {
 			// defer func() {}()
-			results <- lib.Get(fmt.Sprintf("http://%s:%s/list?prefix=%s%s", server.Address, server.Port, prefix, recursiveParam))
+			results <- lib.Get(fmt.Sprintf("http://%s/list?prefix=%s%s", server.HostPort(), prefix, recursiveParam))
 		}(server)
 	}
 	var lines [][]string
@@ -54,8 +60,9 @@ func List(prefix string, recursive bool, servers []lib.Server) ([][]string, erro
 }
 
 type httpRequest struct {
-	url  string
-	Data []byte
+	url     string
+	Data    []byte
+	timeout time.Duration
 }
 
 type httpResult struct {
@@ -65,68 +72,865 @@ type httpResult struct {
 	url        string
 }
 
+type MapError struct {
+	Failures []lib.KeyFailure
+}
+
+func (e *MapError) Error() string {
+	lines := []string{fmt.Sprintf("%d keys failed", len(e.Failures))}
+	for _, failure := range e.Failures {
+		lines = append(lines, fmt.Sprintf("%s %s exit=%s %s", failure.Server, failure.Key, failure.Exit(), failure.LastLine()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+type UnreachableError struct {
+	Servers []string
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("unreachable: %s", strings.Join(e.Servers, ", "))
+}
+
 func postAll(requests []httpRequest, progress func()) error {
 	results := make(chan *httpResult, len(requests))
 	for _, request := range requests {
 		go func(request httpRequest) {
 			// defer func() {}()
-			result := lib.Post(request.url, "application/json", bytes.NewBuffer(request.Data))
+			var result *lib.HTTPResult
+			if request.timeout != 0 {
+				result = lib.PostTimeout(request.url, "application/json", bytes.NewBuffer(request.Data), request.timeout)
+			} else {
+				result = lib.Post(request.url, "application/json", bytes.NewBuffer(request.Data))
+			}
 			results <- &httpResult{result.StatusCode, result.Body, result.Err, request.url}
 		}(request)
 	}
+	var failures []lib.KeyFailure
 	for range requests {
 		result := <-results
 		if result.Err != nil {
 			return result.Err
 		}
+		if result.StatusCode == 422 {
+			var tmp []lib.KeyFailure
+			err := json.Unmarshal(result.Body, &tmp)
+			if err != nil {
+				return err
+			}
+			failures = append(failures, tmp...)
+			progress()
+			continue
+		}
 		if result.StatusCode != 200 {
 			return fmt.Errorf("fatal: %d %s\n%s", result.StatusCode, result.url, result.Body)
 		}
 		progress()
 	}
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool { return failures[i].Key < failures[j].Key })
+		return &MapError{failures}
+	}
 	return nil
 }
 
-func Map(indir string, outdir string, cmd string, servers []lib.Server, progress func()) error {
+func downServers(servers []lib.Server) ([]int, error) {
+	if lib.Conf.Replicas == 1 {
+		return nil, nil
+	}
+	client := http.Client{Timeout: 1 * time.Second}
+	results := make(chan int, len(servers))
+	for i, server := range servers {
+		go func(i int, server lib.Server) {
+			// defer func() {}()
+			resp, err := client.Get(fmt.Sprintf("http://%s/health", server.HostPort()))
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+			if err != nil || resp.StatusCode != 200 {
+				results <- i
+			} else {
+				results <- -1
+			}
+		}(i, server)
+	}
+	var down []int
+	for range servers {
+		i := <-results
+		if i != -1 {
+			down = append(down, i)
+		}
+	}
+	sort.Ints(down)
+	if len(down) >= lib.Conf.Replicas {
+		return nil, fmt.Errorf("too many servers down for replicas %d: %v", lib.Conf.Replicas, down)
+	}
+	return down, nil
+}
+
+type MapOptions struct {
+	Cmds         []string
+	Timeout      time.Duration
+	Retries      int
+	RetryBackoff time.Duration
+	KeepGoing    bool
+	Resume       bool
+	DryRun       bool
+	Limits       lib.Limits
+	JoinIndir    string
+	Join         string
+	Combine      string
+	PartitionBy  string
+	Partitions   int
+	Stream       bool
+	Logs         func(lib.Server, lib.JobLogLine)
+}
+
+func mapRequests(route string, indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server) ([]httpRequest, []int, error) {
+	down, err := downServers(servers)
+	if err != nil {
+		return nil, nil, err
+	}
 	var requests []httpRequest
-	for _, server := range servers {
-		url := fmt.Sprintf("http://%s:%s/map", server.Address, server.Port)
-		d := lib.MapArgs{Cmd: cmd, Indir: indir, Outdir: outdir}
+	for i, server := range servers {
+		if lib.ContainsInt(down, i) {
+			continue
+		}
+		url := fmt.Sprintf("http://%s/%s", server.HostPort(), route)
+		d := lib.MapArgs{
+			Cmd:          cmd,
+			Cmds:         opts.Cmds,
+			Indir:        indir,
+			Outdir:       outdir,
+			Down:         down,
+			Timeout:      opts.Timeout,
+			Retries:      opts.Retries,
+			RetryBackoff: opts.RetryBackoff,
+			KeepGoing:    opts.KeepGoing,
+			Resume:       opts.Resume,
+			DryRun:       opts.DryRun,
+			Limits:       opts.Limits,
+			JoinIndir:    opts.JoinIndir,
+			Join:         opts.Join,
+			Combine:      opts.Combine,
+			PartitionBy:  opts.PartitionBy,
+			Partitions:   opts.Partitions,
+			Stream:       opts.Stream,
+		}
 		bytes, err := json.Marshal(d)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		requests = append(requests, httpRequest{url, bytes})
+		requests = append(requests, httpRequest{url, bytes, lib.HandlerTimeout(d.TotalTimeout())})
 	}
-	return postAll(requests, progress)
+	return requests, down, nil
+}
+
+func runMap(route string, indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server, progress func()) error {
+	id := uuid.Must(uuid.NewV4()).String()
+	requests, down, err := mapRequests(fmt.Sprintf("%s?id=%s", route, id), indir, outdir, cmd, opts, servers)
+	if err != nil {
+		return err
+	}
+	if opts.Logs == nil {
+		return postAll(requests, progress)
+	}
+	var live []lib.Server
+	for i, server := range servers {
+		if !lib.ContainsInt(down, i) {
+			live = append(live, server)
+		}
+	}
+	stop := make(chan struct{})
+	tailed := make(chan error, 1)
+	go func() {
+		// defer func() {}()
+		tailed <- TailLogs(id, live, false, stop, opts.Logs)
+	}()
+	err = postAll(requests, progress)
+	close(stop)
+	tailErr := <-tailed
+	if tailErr != nil {
+		lib.Logger.Printf("failed to tail logs: %s\n", tailErr)
+	}
+	return err
+}
+
+func Map(indir string, outdir string, cmd string, servers []lib.Server, progress func()) error {
+	return MapWithOptions(indir, outdir, cmd, MapOptions{}, servers, progress)
 }
 
 func MapToN(indir string, outdir string, cmd string, servers []lib.Server, progress func()) error {
-	var requests []httpRequest
+	return MapToNWithOptions(indir, outdir, cmd, MapOptions{}, servers, progress)
+}
+
+func MapFromN(indir string, outdir string, cmd string, servers []lib.Server, progress func()) error {
+	return MapFromNWithOptions(indir, outdir, cmd, MapOptions{}, servers, progress)
+}
+
+func MapWithOptions(indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server, progress func()) error {
+	return runMap("map", indir, outdir, cmd, opts, servers, progress)
+}
+
+func MapToNWithOptions(indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server, progress func()) error {
+	return runMap("map_to_n", indir, outdir, cmd, opts, servers, progress)
+}
+
+func MapFromNWithOptions(indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server, progress func()) error {
+	return runMap("map_from_n", indir, outdir, cmd, opts, servers, progress)
+}
+
+func Join(indir string, joinIndir string, outdir string, cmd string, join string, opts MapOptions, servers []lib.Server, progress func()) error {
+	opts.JoinIndir = joinIndir
+	opts.Join = join
+	return runMap("join", indir, outdir, cmd, opts, servers, progress)
+}
+
+func Plan(kind string, indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server) ([]*lib.JobPlan, error) {
+	requests, _, err := mapRequests(kind, indir, outdir, cmd, opts, servers)
+	if err != nil {
+		return nil, err
+	}
+	results := make(chan *httpResult, len(requests))
+	for _, request := range requests {
+		go func(request httpRequest) {
+			// defer func() {}()
+			result := lib.Post(request.url, "application/json", bytes.NewBuffer(request.Data))
+			results <- &httpResult{result.StatusCode, result.Body, result.Err, request.url}
+		}(request)
+	}
+	var plans []*lib.JobPlan
+	for range requests {
+		result := <-results
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		if result.StatusCode != 200 {
+			return nil, fmt.Errorf("fatal: %d %s\n%s", result.StatusCode, result.url, result.Body)
+		}
+		var plan lib.JobPlan
+		err := json.Unmarshal(result.Body, &plan)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, &plan)
+	}
+	sort.Slice(plans, func(i, j int) bool { return plans[i].Server < plans[j].Server })
+	return plans, nil
+}
+
+func TailLogs(id string, servers []lib.Server, follow bool, stop <-chan struct{}, fn func(lib.Server, lib.JobLogLine)) error {
+	next := make([]int, len(servers))
+	finished := make([]bool, len(servers))
+	found := false
+	for {
+		stopped := false
+		if stop != nil {
+			select {
+			case <-stop:
+				stopped = true
+			default:
+			}
+		}
+		for i, server := range servers {
+			if finished[i] {
+				continue
+			}
+			result := lib.Get(fmt.Sprintf("http://%s/logs?id=%s&since=%d", server.HostPort(), id, next[i]))
+			if result.Err != nil {
+				return result.Err
+			}
+			if result.StatusCode == 404 {
+				if stop == nil {
+					finished[i] = true
+				}
+				continue
+			}
+			if result.StatusCode != 200 {
+				return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+			}
+			var logs lib.JobLogs
+			err := json.Unmarshal(result.Body, &logs)
+			if err != nil {
+				return err
+			}
+			for _, line := range logs.Lines {
+				fn(server, line)
+			}
+			next[i] = logs.Next
+			found = true
+			if logs.Done && stop == nil {
+				finished[i] = true
+			}
+		}
+		if stop != nil {
+			if stopped {
+				return nil
+			}
+		} else {
+			if !found {
+				return fmt.Errorf("no such job: %s", id)
+			}
+			done := true
+			for _, f := range finished {
+				done = done && f
+			}
+			if !follow || done {
+				return nil
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func Submit(kind string, indir string, outdir string, cmd string, opts MapOptions, servers []lib.Server) (string, error) {
+	id := uuid.Must(uuid.NewV4()).String()
+	requests, _, err := mapRequests(fmt.Sprintf("jobs?kind=%s&id=%s", kind, id), indir, outdir, cmd, opts, servers)
+	if err != nil {
+		return "", err
+	}
+	return id, postAll(requests, func() {})
+}
+
+func GetJob(id string, servers []lib.Server) ([]*lib.JobStatus, error) {
+	type result struct {
+		i      int
+		result *lib.HTTPResult
+	}
+	results := make(chan result, len(servers))
+	for i, server := range servers {
+		go func(i int, server lib.Server) {
+			// defer func() {}()
+			results <- result{i, lib.Get(fmt.Sprintf("http://%s/jobs?id=%s", server.HostPort(), id))}
+		}(i, server)
+	}
+	statuses := make([]*lib.JobStatus, len(servers))
+	found := false
+	var unreachable []int
+	for range servers {
+		r := <-results
+		if r.result.Err != nil {
+			unreachable = append(unreachable, r.i)
+			continue
+		}
+		if r.result.StatusCode == 404 {
+			continue
+		}
+		if r.result.StatusCode != 200 {
+			return nil, fmt.Errorf("%d %s", r.result.StatusCode, r.result.Body)
+		}
+		var status lib.JobStatus
+		err := json.Unmarshal(r.result.Body, &status)
+		if err != nil {
+			return nil, err
+		}
+		statuses[r.i] = &status
+		found = true
+	}
+	var down []int
+	for _, status := range statuses {
+		if status != nil {
+			down = status.Args.Down
+			break
+		}
+	}
+	var lost []string
+	sort.Ints(unreachable)
+	for _, i := range unreachable {
+		if !lib.ContainsInt(down, i) {
+			lost = append(lost, servers[i].HostPort())
+		}
+	}
+	if !found {
+		if len(lost) > 0 {
+			return nil, &UnreachableError{lost}
+		}
+		return nil, fmt.Errorf("no such job: %s", id)
+	}
+	if len(lost) > 0 {
+		return statuses, &UnreachableError{lost}
+	}
+	return statuses, nil
+}
+
+func Journal(since time.Time, id string, servers []lib.Server) ([]*lib.JobStatus, error) {
+	params := url.Values{}
+	if !since.IsZero() {
+		params.Set("since", since.UTC().Format(time.RFC3339Nano))
+	}
+	if id != "" {
+		params.Set("id", id)
+	}
+	type result struct {
+		server lib.Server
+		*lib.HTTPResult
+	}
+	results := make(chan result, len(servers))
 	for _, server := range servers {
-		url := fmt.Sprintf("http://%s:%s/map_to_n", server.Address, server.Port)
-		d := lib.MapArgs{Cmd: cmd, Indir: indir, Outdir: outdir}
-		bytes, err := json.Marshal(d)
+		go func(server lib.Server) {
+			// defer func() {}()
+			results <- result{server, lib.Get(fmt.Sprintf("http://%s/journal?%s", server.HostPort(), params.Encode()))}
+		}(server)
+	}
+	var statuses []*lib.JobStatus
+	var unreachable []string
+	for range servers {
+		result := <-results
+		if result.Err != nil {
+			unreachable = append(unreachable, result.server.HostPort())
+			continue
+		}
+		if result.StatusCode != 200 {
+			return nil, fmt.Errorf("%d %s", result.StatusCode, result.Body)
+		}
+		var entries []*lib.JobStatus
+		err := json.Unmarshal(result.Body, &entries)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		requests = append(requests, httpRequest{url, bytes})
+		statuses = append(statuses, entries...)
 	}
-	return postAll(requests, progress)
+	sort.SliceStable(statuses, func(i, j int) bool {
+		if !statuses[i].Start.Equal(statuses[j].Start) {
+			return statuses[i].Start.Before(statuses[j].Start)
+		}
+		return statuses[i].Server < statuses[j].Server
+	})
+	if len(unreachable) > 0 {
+		sort.Strings(unreachable)
+		return statuses, &UnreachableError{unreachable}
+	}
+	return statuses, nil
 }
 
-func MapFromN(indir string, outdir string, cmd string, servers []lib.Server, progress func()) error {
-	var requests []httpRequest
+func Cancel(id string, servers []lib.Server) error {
+	type result struct {
+		server lib.Server
+		*httpResult
+	}
+	results := make(chan result, len(servers))
 	for _, server := range servers {
-		url := fmt.Sprintf("http://%s:%s/map_from_n", server.Address, server.Port)
-		d := lib.MapArgs{Cmd: cmd, Indir: indir, Outdir: outdir}
-		bytes, err := json.Marshal(d)
+		go func(server lib.Server) {
+			// defer func() {}()
+			url := fmt.Sprintf("http://%s/cancel?id=%s", server.HostPort(), id)
+			r := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
+			results <- result{server, &httpResult{r.StatusCode, r.Body, r.Err, url}}
+		}(server)
+	}
+	found := false
+	var unreachable []string
+	for range servers {
+		result := <-results
+		if result.Err != nil {
+			unreachable = append(unreachable, result.server.HostPort())
+			continue
+		}
+		if result.StatusCode == 404 {
+			continue
+		}
+		if result.StatusCode != 200 {
+			return fmt.Errorf("fatal: %d %s\n%s", result.StatusCode, result.url, result.Body)
+		}
+		found = true
+	}
+	if !found {
+		if len(unreachable) > 0 {
+			sort.Strings(unreachable)
+			return &UnreachableError{unreachable}
+		}
+		return fmt.Errorf("no such job: %s", id)
+	}
+	return nil
+}
+
+func WaitJob(id string, servers []lib.Server, progress func()) error {
+	done := make(map[int]bool)
+	var failures []lib.KeyFailure
+	for {
+		statuses, err := GetJob(id, servers)
+		var unreachable *UnreachableError
+		if err != nil && (!errors.As(err, &unreachable) || statuses == nil) {
+			return err
+		}
+		var down []int
+		for _, status := range statuses {
+			if status != nil {
+				down = status.Args.Down
+				break
+			}
+		}
+		running := false
+		for i, status := range statuses {
+			if lib.ContainsInt(down, i) || done[i] {
+				continue
+			}
+			if status == nil {
+				if unreachable != nil && lib.Contains(unreachable.Servers, servers[i].HostPort()) {
+					return fmt.Errorf("job lost on unreachable server: %s", servers[i].HostPort())
+				}
+				return fmt.Errorf("job lost on server: %s", servers[i].HostPort())
+			}
+			switch status.Status {
+			case lib.JobRunning:
+				running = true
+			case lib.JobFailed:
+				if len(status.Failures()) == 0 {
+					return fmt.Errorf("fatal: %s\n%s", status.Server, status.Error)
+				}
+				failures = append(failures, status.Failures()...)
+				if !status.Args.KeepGoing {
+					return &MapError{failures}
+				}
+				done[i] = true
+				progress()
+			case lib.JobCancelled:
+				return fmt.Errorf("job cancelled: %s", id)
+			default:
+				done[i] = true
+				progress()
+			}
+		}
+		if !running {
+			if len(failures) > 0 {
+				sort.Slice(failures, func(i, j int) bool { return failures[i].Key < failures[j].Key })
+				return &MapError{failures}
+			}
+			return nil
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+type Stage struct {
+	Name         string   `json:"name"`
+	Kind         string   `json:"kind"`
+	Indir        string   `json:"indir,omitempty"`
+	JoinIndir    string   `json:"join_indir,omitempty"`
+	How          string   `json:"how,omitempty"`
+	Key          string   `json:"key,omitempty"`
+	Outdir       string   `json:"outdir,omitempty"`
+	Cmd          string   `json:"cmd"`
+	Cmds         []string `json:"cmds,omitempty"`
+	Combine      string   `json:"combine,omitempty"`
+	PartitionBy  string   `json:"partition_by,omitempty"`
+	Partitions   int      `json:"partitions,omitempty"`
+	Timeout      string   `json:"timeout,omitempty"`
+	Retries      int      `json:"retries,omitempty"`
+	RetryBackoff string   `json:"retry_backoff,omitempty"`
+	KeepGoing    bool     `json:"keep_going,omitempty"`
+	Keep         bool     `json:"keep,omitempty"`
+}
+
+type Pipeline struct {
+	Stages []Stage `json:"stages"`
+}
+
+func LoadPipeline(path string) (*Pipeline, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	var pipeline Pipeline
+	err = decoder.Decode(&pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("bad pipeline %s: %w", path, err)
+	}
+	return &pipeline, nil
+}
+
+func (stage Stage) inputs() []string {
+	var inputs []string
+	for _, input := range []string{stage.Indir, stage.JoinIndir, stage.Key} {
+		if input != "" {
+			indir, _ := lib.ParseGlob(input)
+			inputs = append(inputs, indir)
+		}
+	}
+	return inputs
+}
+
+func (stage Stage) reads(outdir string) bool {
+	if outdir == "" {
+		return false
+	}
+	for _, input := range stage.inputs() {
+		if strings.HasPrefix(input, outdir) || strings.HasPrefix(outdir, input) {
+			return true
+		}
+	}
+	return false
+}
+
+func (stage Stage) validate() error {
+	if stage.Name == "" {
+		return fmt.Errorf("stage missing name")
+	}
+	switch stage.Kind {
+	case lib.KindMap, lib.KindMapToN, lib.KindMapFromN, lib.KindJoin:
+		if stage.Indir == "" || stage.Outdir == "" {
+			return fmt.Errorf("stage %s needs indir and outdir", stage.Name)
+		}
+		if stage.Kind == lib.KindJoin && stage.JoinIndir == "" {
+			return fmt.Errorf("stage %s needs join_indir", stage.Name)
+		}
+	case "eval":
+		if stage.Key == "" {
+			return fmt.Errorf("stage %s needs key", stage.Name)
+		}
+	default:
+		return fmt.Errorf("stage %s has unknown kind: %s", stage.Name, stage.Kind)
+	}
+	if len(stage.Cmds) > 0 && stage.Kind != lib.KindMap {
+		return fmt.Errorf("stage %s: cmds are only supported by map", stage.Name)
+	}
+	for _, duration := range []string{stage.Timeout, stage.RetryBackoff} {
+		if duration != "" {
+			_, err := time.ParseDuration(duration)
+			if err != nil {
+				return fmt.Errorf("stage %s: %w", stage.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (pipeline *Pipeline) Order() ([]Stage, error) {
+	names := make(map[string]bool)
+	for _, stage := range pipeline.Stages {
+		err := stage.validate()
+		if err != nil {
+			return nil, err
+		}
+		if names[stage.Name] {
+			return nil, fmt.Errorf("duplicate stage name: %s", stage.Name)
+		}
+		names[stage.Name] = true
+	}
+	done := make([]bool, len(pipeline.Stages))
+	var order []Stage
+	for len(order) < len(pipeline.Stages) {
+		progressed := false
+		for i, stage := range pipeline.Stages {
+			if done[i] {
+				continue
+			}
+			ready := true
+			for j, dep := range pipeline.Stages {
+				if j != i && !done[j] && stage.reads(dep.Outdir) {
+					ready = false
+				}
+			}
+			if ready && !stage.reads(stage.Outdir) {
+				done[i] = true
+				order = append(order, stage)
+				progressed = true
+			}
+		}
+		if !progressed {
+			return nil, fmt.Errorf("pipeline has a cycle")
+		}
+	}
+	return order, nil
+}
+
+func (pipeline *Pipeline) intermediate(stage Stage) bool {
+	if stage.Keep || stage.Outdir == "" {
+		return false
+	}
+	for _, other := range pipeline.Stages {
+		if other.Name != stage.Name && other.reads(stage.Outdir) {
+			return true
+		}
+	}
+	return false
+}
+
+func (stage Stage) fingerprint() string {
+	bytes, err := json.Marshal(stage)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%016x", xxhash.Sum64(bytes))
+}
+
+type pipelineState struct {
+	Started map[string]string `json:"started"`
+	Done    map[string]string `json:"done"`
+}
+
+func (state *pipelineState) write(statePath string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, data, 0o644)
+}
+
+func RunPipeline(pipeline *Pipeline, statePath string, out io.Writer, servers []lib.Server, progress func(stage string, status string)) error {
+	stages, err := pipeline.Order()
+	if err != nil {
+		return err
+	}
+	state := &pipelineState{}
+	data, err := os.ReadFile(statePath)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(data, state)
+		if err != nil {
+			return fmt.Errorf("bad pipeline state %s: %w", statePath, err)
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+	if state.Started == nil {
+		state.Started = make(map[string]string)
+	}
+	if state.Done == nil {
+		state.Done = make(map[string]string)
+	}
+	for _, stage := range stages {
+		fingerprint := stage.fingerprint()
+		if state.Done[stage.Name] == fingerprint {
+			progress(stage.Name, "skipped")
+			continue
+		}
+		started, ranBefore := state.Started[stage.Name]
+		if _, done := state.Done[stage.Name]; done {
+			ranBefore = true
+		}
+		resume := ranBefore && started == fingerprint && stage.Combine == ""
+		if ranBefore && !resume && stage.Kind != "eval" {
+			err := Rm(stage.Outdir, true, servers)
+			if err != nil {
+				return err
+			}
+		}
+		state.Started[stage.Name] = fingerprint
+		delete(state.Done, stage.Name)
+		err := state.write(statePath)
+		if err != nil {
+			return err
+		}
+		progress(stage.Name, "running")
+		err = runStage(stage, resume, out, servers)
+		if err != nil {
+			progress(stage.Name, "failed")
+			return fmt.Errorf("stage %s failed: %w", stage.Name, err)
+		}
+		state.Done[stage.Name] = fingerprint
+		err = state.write(statePath)
+		if err != nil {
+			return err
+		}
+		progress(stage.Name, "done")
+	}
+	for _, stage := range stages {
+		if pipeline.intermediate(stage) {
+			err := Rm(stage.Outdir, true, servers)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(statePath)
+}
+
+func runStage(stage Stage, resume bool, out io.Writer, servers []lib.Server) error {
+	if stage.Kind == "eval" {
+		result, err := Eval(stage.Key, stage.Cmd, servers)
 		if err != nil {
 			return err
 		}
-		requests = append(requests, httpRequest{url, bytes})
+		_, err = fmt.Fprintln(out, result)
+		return err
+	}
+	opts := MapOptions{
+		Cmds:        stage.Cmds,
+		Retries:     stage.Retries,
+		KeepGoing:   stage.KeepGoing,
+		Resume:      resume,
+		Combine:     stage.Combine,
+		PartitionBy: stage.PartitionBy,
+		Partitions:  stage.Partitions,
+		JoinIndir:   stage.JoinIndir,
+		Join:        stage.How,
 	}
-	return postAll(requests, progress)
+	opts.RetryBackoff = time.Second
+	if stage.RetryBackoff != "" {
+		opts.RetryBackoff, _ = time.ParseDuration(stage.RetryBackoff)
+	}
+	if stage.Timeout != "" {
+		opts.Timeout, _ = time.ParseDuration(stage.Timeout)
+	}
+	return runMap(stage.Kind, stage.Indir, stage.Outdir, stage.Cmd, opts, servers, func() {})
+}
+
+type Usage struct {
+	Server lib.Server `json:"-"`
+	Keys   int64      `json:"keys"`
+	Bytes  int64      `json:"bytes"`
+}
+
+func Du(prefix string, servers []lib.Server) ([]Usage, error) {
+	type result struct {
+		i      int
+		result *lib.HTTPResult
+	}
+	results := make(chan result, len(servers))
+	for i, server := range servers {
+		go func(i int, server lib.Server) {
+			// defer func() {}()
+			results <- result{i, lib.Get(fmt.Sprintf("http://%s/du?prefix=%s", server.HostPort(), prefix))}
+		}(i, server)
+	}
+	usages := make([]Usage, len(servers))
+	for range servers {
+		r := <-results
+		if r.result.Err != nil {
+			return []Usage{}, r.result.Err
+		}
+		if r.result.StatusCode != 200 {
+			return []Usage{}, fmt.Errorf("%d %s", r.result.StatusCode, r.result.Body)
+		}
+		err := json.Unmarshal(r.result.Body, &usages[r.i])
+		if err != nil {
+			return []Usage{}, err
+		}
+		usages[r.i].Server = servers[r.i]
+	}
+	return usages, nil
+}
+
+func Rebalance(servers []lib.Server, progress func()) (int, error) {
+	results := make(chan *httpResult, len(servers))
+	for _, server := range servers {
+		go func(server lib.Server) {
+			// defer func() {}()
+			url := fmt.Sprintf("http://%s/rebalance", server.HostPort())
+			result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
+			results <- &httpResult{result.StatusCode, result.Body, result.Err, url}
+		}(server)
+	}
+	sent := 0
+	for range servers {
+		result := <-results
+		if result.Err != nil {
+			return sent, result.Err
+		}
+		if result.StatusCode != 200 {
+			return sent, fmt.Errorf("fatal: %d %s\n%s", result.StatusCode, result.url, result.Body)
+		}
+		count, err := strconv.Atoi(string(result.Body))
+		if err != nil {
+			return sent, err
+		}
+		sent += count
+		progress()
+	}
+	return sent, nil
 }
 
 func Rm(prefix string, recursive bool, servers []lib.Server) error {
@@ -138,7 +942,7 @@ func Rm(prefix string, recursive bool, servers []lib.Server) error {
 		for _, server := range servers {
 			go func(server lib.Server) {
 				// defer func() {}()
-				results <- lib.Post(fmt.Sprintf("http://%s:%s/delete?prefix=%s&recursive=true", server.Address, server.Port, prefix), "application/text", bytes.NewBuffer([]byte{}))
+				results <- lib.Post(fmt.Sprintf("http://%s/delete?prefix=%s&recursive=true", server.HostPort(), prefix), "application/text", bytes.NewBuffer([]byte{}))
 			}(server)
 		}
 		for range servers {
@@ -151,39 +955,46 @@ func Rm(prefix string, recursive bool, servers []lib.Server) error {
 			}
 		}
 	} else {
-		server, err := lib.PickServer(prefix, servers)
+		replicas, err := lib.PickServers(prefix, servers)
 		if err != nil {
 			return err
 		}
-		result := lib.Post(fmt.Sprintf("http://%s:%s/delete?prefix=%s", server.Address, server.Port, prefix), "application/text", bytes.NewBuffer([]byte{}))
-		if result.Err != nil {
-			return result.Err
-		}
-		if result.StatusCode != 200 {
-			return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+		for _, server := range replicas {
+			result := lib.Post(fmt.Sprintf("http://%s/delete?prefix=%s", server.HostPort(), prefix), "application/text", bytes.NewBuffer([]byte{}))
+			if result.Err != nil {
+				return result.Err
+			}
+			if result.StatusCode != 200 {
+				return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+			}
 		}
 	}
 	return nil
 }
 
 func Eval(key string, cmd string, servers []lib.Server) (string, error) {
-	server, err := lib.PickServer(key, servers)
+	replicas, err := lib.PickServers(key, servers)
 	if err != nil {
 		return "", err
 	}
-	url := fmt.Sprintf("http://%s:%s/eval?key=%s", server.Address, server.Port, key)
-	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte(cmd)))
-	if result.Err != nil {
-		return "", result.Err
-	}
-	switch result.StatusCode {
-	case 404:
-		return "", fmt.Errorf("no such key: %s", key)
-	case 200:
-		return string(result.Body), nil
-	default:
-		return "", fmt.Errorf("%d %s", result.StatusCode, result.Body)
+	err = fmt.Errorf("no such key: %s", key)
+	for _, server := range replicas {
+		url := fmt.Sprintf("http://%s/eval?key=%s", server.HostPort(), key)
+		result := lib.Post(url, "application/text", bytes.NewBuffer([]byte(cmd)))
+		if result.Err != nil {
+			err = result.Err
+			continue
+		}
+		switch result.StatusCode {
+		case 404:
+			continue
+		case 200:
+			return string(result.Body), nil
+		default:
+			return "", fmt.Errorf("%d %s", result.StatusCode, result.Body)
+		}
 	}
+	return "", err
 }
 
 func ListBuckets(servers []lib.Server) ([][]string, error) {
@@ -191,7 +1002,7 @@ func ListBuckets(servers []lib.Server) ([][]string, error) {
 	for _, server := range servers {
 		go func(server lib.Server) {
 			// defer func() {}()
-			results <- lib.Get(fmt.Sprintf("http://%s:%s/list_buckets", server.Address, server.Port))
+			results <- lib.Get(fmt.Sprintf("http://%s/list_buckets", server.HostPort()))
 		}(server)
 	}
 	buckets := make(map[string][]string)
@@ -286,8 +1097,29 @@ func putRecursive(src string, dst string, servers []lib.Server) error {
 	})
 }
 
+func prepareGet(src string, port string, replicas []lib.Server) (lib.Server, []byte, error) {
+	err := fmt.Errorf("no such key: %s", src)
+	for _, server := range replicas {
+		url := fmt.Sprintf("http://%s/prepare_get?key=%s&port=%s", server.HostPort(), src, port)
+		result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
+		if result.Err != nil {
+			err = result.Err
+			continue
+		}
+		if result.StatusCode == 404 {
+			continue
+		}
+		if result.StatusCode != 200 {
+			err = fmt.Errorf("%d %s", result.StatusCode, result.Body)
+			continue
+		}
+		return server, result.Body, nil
+	}
+	return lib.Server{}, nil, err
+}
+
 func GetFile(src string, dst string, servers []lib.Server) error {
-	server, err := lib.PickServer(src, servers)
+	replicas, err := lib.PickServers(src, servers)
 	if err != nil {
 		return err
 	}
@@ -302,21 +1134,16 @@ func GetFile(src string, dst string, servers []lib.Server) error {
 		clientChecksum, _err = lib.RecvFile(tempPath, port)
 		fail <- _err
 	}()
-	url := fmt.Sprintf("http://%s:%s/prepare_get?key=%s&port=%s", server.Address, server.Port, src, <-port)
-	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
-	if result.StatusCode == 404 {
-		return fmt.Errorf("no such key: %s", src)
-	}
-	if result.StatusCode != 200 {
-		return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+	server, uid, err := prepareGet(src, <-port, replicas)
+	if err != nil {
+		return err
 	}
-	uid := result.Body
 	err = <-fail
 	if err != nil {
 		return err
 	}
-	url = fmt.Sprintf("http://%s:%s/confirm_get?uuid=%s&checksum=%s", server.Address, server.Port, uid, clientChecksum)
-	result = lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
+	url := fmt.Sprintf("http://%s/confirm_get?uuid=%s&checksum=%s", server.HostPort(), uid, clientChecksum)
+	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
 	if result.StatusCode != 200 {
 		return fmt.Errorf("%d %s", result.StatusCode, result.Body)
 	}
@@ -337,7 +1164,7 @@ func GetFile(src string, dst string, servers []lib.Server) error {
 }
 
 func GetWriter(src string, dst io.Writer, servers []lib.Server) error {
-	server, err := lib.PickServer(src, servers)
+	replicas, err := lib.PickServers(src, servers)
 	if err != nil {
 		return err
 	}
@@ -350,21 +1177,16 @@ func GetWriter(src string, dst io.Writer, servers []lib.Server) error {
 		clientChecksum, _err = lib.Recv(dst, port)
 		fail <- _err
 	}()
-	url := fmt.Sprintf("http://%s:%s/prepare_get?key=%s&port=%s", server.Address, server.Port, src, <-port)
-	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
-	if result.StatusCode == 404 {
-		return fmt.Errorf("no such key: %s", src)
-	}
-	if result.StatusCode != 200 {
-		return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+	server, uid, err := prepareGet(src, <-port, replicas)
+	if err != nil {
+		return err
 	}
-	uid := result.Body
 	err = <-fail
 	if err != nil {
 		return err
 	}
-	url = fmt.Sprintf("http://%s:%s/confirm_get?uuid=%s&checksum=%s", server.Address, server.Port, uid, clientChecksum)
-	result = lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
+	url := fmt.Sprintf("http://%s/confirm_get?uuid=%s&checksum=%s", server.HostPort(), uid, clientChecksum)
+	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
 	if result.StatusCode != 200 {
 		return fmt.Errorf("%d %s", result.StatusCode, result.Body)
 	}
@@ -377,48 +1199,65 @@ func PutFile(src string, dst string, servers []lib.Server) error {
 	if strings.HasSuffix(dst, "/") {
 		dst = lib.Join(dst, path.Base(src))
 	}
-	server, err := lib.PickServer(dst, servers)
+	replicas, err := lib.PickServers(dst, servers)
 	if err != nil {
 		return err
 	}
-	url := fmt.Sprintf("http://%s:%s/prepare_put?key=%s", server.Address, server.Port, dst)
-	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
-	if result.Err != nil {
-		return result.Err
+	for _, server := range replicas {
+		err := PutFileTo(src, dst, server)
+		if err != nil {
+			return err
+		}
 	}
-	if result.StatusCode == 409 {
-		return fmt.Errorf("key already exists: %s %w", dst, Err409)
+	return nil
+}
+
+func PutFileTo(src string, dst string, server lib.Server) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
 	}
-	if result.StatusCode != 200 {
-		return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+	err = putReader(f, dst, server)
+	if err != nil {
+		_ = f.Close()
+		return err
 	}
-	vals := strings.Split(string(result.Body), " ")
-	if len(vals) != 2 {
-		return fmt.Errorf("bad put response: %s", result.Body)
+	return f.Close()
+}
+
+func PutReader(src io.Reader, dst string, servers []lib.Server) error {
+	replicas, err := lib.PickServers(dst, servers)
+	if err != nil {
+		return err
 	}
-	uid := vals[0]
-	port := vals[1]
-	clientChecksum, err := lib.SendFile(src, server.Address, port)
+	if len(replicas) == 1 {
+		return putReader(src, dst, replicas[0])
+	}
+	f, err := os.CreateTemp("", "s4.")
 	if err != nil {
 		return err
 	}
-	url = fmt.Sprintf("http://%s:%s/confirm_put?uuid=%s&checksum=%s", server.Address, server.Port, uid, clientChecksum)
-	result = lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
-	if result.Err != nil {
-		return result.Err
+	defer func() { _ = os.Remove(f.Name()) }()
+	_, err = io.Copy(f, src)
+	if err != nil {
+		_ = f.Close()
+		return err
 	}
-	if result.StatusCode != 200 {
-		return fmt.Errorf("%d %s", result.StatusCode, result.Body)
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	for _, server := range replicas {
+		err := PutFileTo(f.Name(), dst, server)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func PutReader(src io.Reader, dst string, servers []lib.Server) error {
-	server, err := lib.PickServer(dst, servers)
-	if err != nil {
-		return err
-	}
-	url := fmt.Sprintf("http://%s:%s/prepare_put?key=%s", server.Address, server.Port, dst)
+func putReader(src io.Reader, dst string, server lib.Server) error {
+	url := fmt.Sprintf("http://%s/prepare_put?key=%s", server.HostPort(), dst)
 	result := lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
 	if result.Err != nil {
 		return result.Err
@@ -439,7 +1278,7 @@ func PutReader(src io.Reader, dst string, servers []lib.Server) error {
 	if err != nil {
 		return err
 	}
-	url = fmt.Sprintf("http://%s:%s/confirm_put?uuid=%s&checksum=%s", server.Address, server.Port, uid, clientChecksum)
+	url = fmt.Sprintf("http://%s/confirm_put?uuid=%s&checksum=%s", server.HostPort(), uid, clientChecksum)
 	result = lib.Post(url, "application/text", bytes.NewBuffer([]byte{}))
 	if result.Err != nil {
 		return result.Err
@@ -1,4 +1,5 @@
 import hashlib
+import json
 import contextlib
 import pytest
 import logging
@@ -37,11 +38,11 @@ def start(port, conf, extra=''):
         assert False, f'failed to start server on ports from: {port}'
 
 @retry
-def start_all(extra='', num=3):
+def start_all(extra='', num=3, conf_lines=''):
     ports = [util.net.free_port() for _ in range(num)]
     conf = os.environ['S4_CONF_PATH'] = os.path.abspath(run('mktemp -p .'))
     with open(conf, 'w') as f:
-        f.write('\n'.join(f'0.0.0.0:{port}' for port in ports) + '\n')
+        f.write(conf_lines + '\n'.join(f'0.0.0.0:{port}' for port in ports) + '\n')
     procs = [pool.proc.new(start, port, conf, extra) for port in ports]
     try:
         for _ in range(50):
@@ -71,13 +72,13 @@ def watcher(watch, procs):
                 os._exit(1)
 
 @contextlib.contextmanager
-def servers(timeout=30, extra_conf='', num_servers=3):
+def servers(timeout=30, extra_conf='', num_servers=3, conf_lines=''):
     util.log.setup(format='%(message)s')
     shell.set['stream'] = True
     with util.time.timeout(timeout):
         with shell.stream():
             with shell.tempdir():
-                procs = start_all(extra_conf, num_servers)
+                procs = start_all(extra_conf, num_servers, conf_lines)
                 watch = [True]
                 pool.thread.new(watcher, watch, procs)
                 try:
@@ -106,6 +107,61 @@ def test_eval():
         run('echo 123 | s4 cp - s4://bucket/file.txt')
         assert '123' == run('s4 eval s4://bucket/file.txt "cat"')
 
+def test_replicas():
+    with servers(conf_lines='replicas 2\n'):
+        run('echo 123 | s4 cp - s4://bucket/dir/file.txt')
+        assert 2 == len(run('find . -type f -name file.txt').splitlines())
+        assert '123' == run('s4 cp s4://bucket/dir/file.txt -')
+        assert '123' == run('s4 eval s4://bucket/dir/file.txt "cat"')
+        run('s4 map s4://bucket/dir/ s4://bucket/out/ "sed s/1/4/"')
+        assert 2 == len(run('find . -type f -path "*/out/file.txt"').splitlines())
+        assert run("s4 ls -r s4://bucket/out/ | awk '{print $NF}'") == 'out/file.txt'
+        assert '423' == run('s4 cp s4://bucket/out/file.txt -')
+        run('s4 rm s4://bucket/dir/file.txt')
+        assert '' == run('find . -type f -name file.txt -path "*/dir/*"')
+
+def test_replicas_down():
+    with servers(conf_lines='replicas 2\n0.0.0.0:1\n'):
+        run('echo 1 | s4 cp - s4://bucket/in/00001')
+        res = run("s4 map-to-n s4://bucket/in/ s4://bucket/out/ 'cat > 00003; echo 00003'", warn=True)
+        assert res['exitcode'] != 0
+        assert 'replica 0.0.0.0:1 is down' in res['stderr']
+        run("s4 map-to-n s4://bucket/in/ s4://bucket/out2/ 'cat > 00002; echo 00002'")
+        assert 2 == len(run('find . -type f -path "*/out2/00001/00002"').splitlines())
+        run("s4 map-to-n -logs s4://bucket/in/ s4://bucket/out3/ 'cat > 00002; echo 00002; echo log >&2'")
+
+def test_rebalance():
+    with servers(conf_lines='replicas 2\n'):
+        for i in range(6):
+            run(f's4 cp - s4://bucket/dir/{i:05}', stdin=f'{i}\n')
+        copy = run('find . -type f -path "*/s4_data/bucket/dir/00000" | head -1')
+        run(f'rm {copy} {copy}.xxh')
+        run(f'mkdir -p $(dirname $(dirname $(dirname {copy})))/bucket/empty')
+        assert 'sent 1 keys' in run('s4 rebalance')
+        assert 2 == len(run('find . -type f -path "*/s4_data/bucket/dir/00000"').splitlines())
+        with open(os.environ['S4_CONF_PATH']) as f:
+            conf = f.read()
+        with open(os.environ['S4_CONF_PATH'], 'w') as f:
+            f.write(conf.replace('replicas 2\n', ''))
+        run('pkill -f "^s4-server -port"')
+        for _ in range(50):
+            if run('s4 health', warn=True)['exitcode'] == 0:
+                break
+            time.sleep(.1)
+        run('s4 rebalance')
+        assert 6 == len(run('find . -type f -path "*/s4_data/bucket/dir/0000*" -not -name "*.xxh"').splitlines())
+        assert [run(f's4 cp s4://bucket/dir/{i:05} -') for i in range(6)] == [str(i) for i in range(6)]
+        assert run('find . -type d -path "*/s4_data/bucket/empty"')
+
+def test_conf_mismatch():
+    with servers():
+        run('tac $S4_CONF_PATH > reversed.conf')
+        run('echo | s4 cp - s4://bucket/file.txt')
+        with pytest.raises(Exception):
+            run('echo | s4 cp -c reversed.conf - s4://bucket/file2.txt')
+        assert 'conf mismatch' in run('s4 health -c reversed.conf', warn=True)['stdout']
+        run('s4 health')
+
 def test_recv_timeout():
     with servers(extra_conf='-max-io-jobs 1', num_servers=1):
         with open(os.environ['S4_CONF_PATH']) as f:
@@ -362,6 +418,246 @@ def test_map():
         run(f's4 cp -r {dst}/ result')
         assert run('cat result/*', stream=False) == '\n'.join(words).lower()
 
+def test_map_fused():
+    with servers():
+        src = 's4://bucket/data_in'
+        run(f's4 cp - {src}/00000', stdin='a\nb\nc\n')
+        run(f's4 map {src}/ s4://bucket/out/ "tr a-z A-Z" "grep -v B" "sed s/$/!/"')
+        assert run('s4 cp s4://bucket/out/00000 -').splitlines() == ['A!', 'C!']
+        res = run(f's4 map -keep-going {src}/ s4://bucket/fail/ cat "grep x" cat', warn=True)
+        assert res['exitcode'] != 0
+        assert 'stage 2 failed: exit 1' in res['stderr']
+        assert run('s4 ls -r s4://bucket/fail/', warn=True)['stdout'] == ''
+        res = run(f"s4 map {src}/ s4://bucket/fail2/ 'false; cat' cat", warn=True)
+        assert res['exitcode'] != 0
+        assert 'stage 1 failed: exit 1' in res['stderr']
+        assert run('s4 ls -r s4://bucket/fail2/', warn=True)['stdout'] == ''
+        res = run(f's4 map {src}/ s4://bucket/flag/ cat -retries 1', warn=True)
+        assert res['exitcode'] != 0
+        assert 'flags must come before INDIR, got: -retries' in res['stderr']
+
+def test_map_async():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        for i in range(4):
+            run(f's4 cp - {src}/{i:05}', stdin=f'line {i}\n')
+        job = run(f's4 map -async {src}/ {dst}/ "tr a-z A-Z"')
+        run(f's4 job wait {job}')
+        assert all(line.split()[2] == 'succeeded' for line in run(f's4 job status {job}').splitlines() if not line.startswith(' '))
+        assert run(f's4 cp {dst}/00003 -') == 'LINE 3'
+        job = run(f's4 map -async {src}/ {dst}_fail/ "false"')
+        with pytest.raises(Exception):
+            run(f's4 job wait {job}')
+        assert 'failed' in run(f's4 job status {job}')
+
+def test_job_server_down():
+    with servers(conf_lines='replicas 2\n0.0.0.0:1\n'):
+        run('s4 cp - s4://bucket/in/00001', stdin='1\n')
+        job = run("s4 map -async s4://bucket/in/ s4://bucket/out/ 'sleep 1; cat'")
+        run(f's4 job status {job}')
+        run(f's4 job wait {job}')
+        assert run('s4 cp s4://bucket/out/00001 -') == '1'
+        for cmd in ['s4 jobs', f's4 job show {job}']:
+            res = run(cmd, warn=True)
+            assert res['exitcode'] != 0
+            assert job in res['stdout']
+            assert 'unreachable: 0.0.0.0:1' in res['stderr']
+    with servers(conf_lines='replicas 2\n'):
+        for i in range(6):
+            run(f's4 cp - s4://bucket/in/{i:05}', stdin=f'{i}\n')
+        job = run("s4 map -async s4://bucket/in/ s4://bucket/out/ 'sleep 5; cat'")
+        with open(os.environ['S4_CONF_PATH']) as f:
+            port = f.read().splitlines()[-1].split(':')[1]
+        run(f'pkill -f "^s4-server -port {port} "')
+        res = run(f's4 job wait {job}', warn=True)
+        assert res['exitcode'] != 0
+        assert 'job lost on' in res['stderr'] and f'server: 0.0.0.0:{port}' in res['stderr']
+
+def test_submit_dry_run():
+    with servers(num_servers=1):
+        with open(os.environ['S4_CONF_PATH']) as f:
+            _server = f.read().splitlines()[0]
+        run('s4 cp - s4://bucket/in/00001', stdin='1\n')
+        args = {'cmd': 'cat', 'indir': 's4://bucket/in/', 'outidr': 's4://bucket/out/', 'dry_run': True}
+        resp = requests.post(f'http://{_server}/jobs?kind=map&id=dry', data=json.dumps(args), timeout=5)
+        assert resp.status_code == 400, resp
+        assert run('s4 jobs').splitlines()[1:] == []
+        assert run('s4 ls -r s4://bucket/out/', warn=True)['stdout'] == ''
+
+def test_map_cancel():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        for i in range(4):
+            run(f's4 cp - {src}/{i:05}', stdin=f'line {i}\n')
+        job = run(f's4 map -async {src}/ {dst}/ "sleep 300 | cat"')
+        time.sleep(1)
+        run(f's4 cancel {job}')
+        with pytest.raises(Exception):
+            run(f's4 job wait {job}')
+        assert all(line.split()[2] == 'cancelled' for line in run(f's4 job status {job}').splitlines() if not line.startswith(' '))
+        assert run('ps -eo args | grep "^sleep 300" || true') == ''
+
+def test_jobs_journal():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        for i in range(4):
+            run(f's4 cp - {src}/{i:05}', stdin=f'line {i}\n')
+        run(f's4 map {src}/ {dst}/ "tr a-z A-Z"')
+        run(f's4 map -keep-going {src}/ {dst}_fail/ "grep -v 3"', warn=True)
+        lines = run('s4 jobs').splitlines()[1:]
+        assert len(lines) == 2
+        assert lines[0].split()[3] == 'succeeded'
+        assert lines[0].split()[5:7] == ['4', '0']
+        assert lines[1].split()[3] == 'failed'
+        assert lines[1].split()[5:7] == ['4', '1']
+        assert lines[1].split()[9] == f'{dst}_fail/'
+        assert run('s4 jobs -since 2000-01-01T00:00:00Z').splitlines()[1:] == lines
+        assert run('s4 jobs -since 1ns').splitlines()[1:] == []
+        job = lines[1].split()[1]
+        show = run(f's4 job show {job}').splitlines()
+        assert show[:2] == [f'id {job}', 'kind map']
+        assert f'outdir {dst}_fail/' in show
+        assert 'cmd grep -v 3' in show
+        failed = [line.split() for line in show if line.startswith('  failed')]
+        assert len(failed) == 1
+        assert failed[0][1] == f'{src}/00003'
+        assert failed[0][3] == 'exit=1'
+        assert run('s4 job show nope', warn=True)['exitcode'] != 0
+        run('for f in _*/s4_data/_jobs/journal.jsonl; do printf "garbage\\n{\\"id\\": \\"torn" >> $f; done')
+        assert run('s4 jobs').splitlines()[1:] == lines
+
+def test_map_timeout():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        run(f's4 cp - {src}/00000', stdin='line\n')
+        with pytest.raises(Exception):
+            run(f's4 map -timeout 1s {src}/ {dst}/ "sleep 3 | cat"')
+        run(f's4 map -timeout 10s {src}/ {dst}/ "sleep 2 | cat"')
+        assert run(f's4 cp {dst}/00000 -') == 'line'
+        with pytest.raises(Exception):
+            run(f's4 map -timeout 48h {src}/ {dst}_long/ "cat"')
+
+def test_map_logs():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        run(f's4 cp - {src}/00000', stdin='line\n')
+        stderr = run(f's4 map -logs {src}/ {dst}/ "bash -c \'echo working >&2; cat\'" 2>&1 >/dev/null')
+        assert stderr.split()[1:] == [f'{src}/00000', 'working']
+        job = run(f's4 map -async {src}/ {dst}_async/ "bash -c \'echo working >&2; cat\'"')
+        stderr = run(f's4 job -f logs {job} 2>&1')
+        assert stderr.split()[1:] == [f'{src}/00000', 'working']
+
+def test_map_retries():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        run(f's4 cp - {src}/00000', stdin='line\n')
+        counter = os.path.abspath('counter')
+        cmd = f'bash -c "n=\\$(cat {counter} 2>/dev/null || echo 0); echo \\$((n+1)) > {counter}; [ \\$n -ge 2 ] || exit 1; cat"'
+        with pytest.raises(Exception):
+            run(f"s4 map -retries 1 -retry-backoff 10ms {src}/ {dst}/ '{cmd}'")
+        run(f'rm {counter}')
+        job = run(f"s4 map -async -retries 2 -retry-backoff 10ms {src}/ {dst}/ '{cmd}'")
+        run(f's4 job wait {job}')
+        assert 'attempts=3' in run(f's4 job status {job}')
+        assert run(f's4 cp {dst}/00000 -') == 'line'
+
+def test_map_keep_going():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        for i in range(6):
+            run(f's4 cp - {src}/{i:05}', stdin=f'line {i}\n')
+        cmd = 'bash -c "case \\$filename in 00001|00004) echo bad \\$filename >&2; exit 3;; esac; cat"'
+        res = run(f"s4 map -keep-going {src}/ {dst}/ '{cmd}'", warn=True)
+        assert res['exitcode'] != 0
+        lines = res['stderr'].splitlines()
+        assert [line.split()[1:] for line in lines if ' 3 ' in line] == [[f'{src}/00001', '3', 'bad', '00001'],
+                                                                        [f'{src}/00004', '3', 'bad', '00004']]
+        assert run(f"s4 ls {dst}/ | awk '{{print $NF}}'").splitlines() == ['00000', '00002', '00003', '00005']
+
+def test_map_resume():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        for i in range(4):
+            run(f's4 cp - {src}/{i:05}', stdin=f'line {i}\n')
+        cmd = 'bash -c "[ \\$filename != 00002 ] || exit 1; cat"'
+        with pytest.raises(Exception):
+            run(f"s4 map -keep-going {src}/ {dst}/ '{cmd}'")
+        with pytest.raises(Exception):
+            run(f's4 map {src}/ {dst}/ "tr a-z A-Z"')
+        run(f's4 map -resume {src}/ {dst}/ "tr a-z A-Z"')
+        assert run(f's4 cp {dst}/00001 -') == 'line 1'
+        assert run(f's4 cp {dst}/00002 -') == 'LINE 2'
+        shuf = 's4://bucket/shuf'
+        with pytest.raises(Exception):
+            run(f"s4 map-to-n -keep-going {src}/ {shuf}/ 'bash -c \"[ \\$filename != 00002 ] || exit 1; cat > a; echo a\"'")
+        run(f's4 map-to-n -resume {src}/ {shuf}/ "cat > a; echo a"')
+        assert run(f"s4 ls -r {shuf}/ | awk '{{print $NF}}'").splitlines() == [f'shuf/{i:05}/a' for i in range(4)]
+        run(f's4 map-to-n -resume {src}/ {shuf}/ "cat > a; echo a"')
+        run(f's4 map-to-n -resume {src}/ {shuf}/ "tr a-z A-Z > a; echo a"')
+        assert run(f's4 cp {shuf}/00001/a -') == 'LINE 1'
+        assert run(f"s4 ls -r {shuf}/ | awk '{{print $NF}}'").splitlines() == [f'shuf/{i:05}/a' for i in range(4)]
+
+def test_map_dry_run():
+    with servers():
+        src = 's4://bucket/data_in'
+        dst = 's4://bucket/data_out'
+        for i in range(3):
+            run(f's4 cp - {src}/{i:05}', stdin=f'line {i}\n')
+        lines = sorted(line.split()[1:] for line in run(f's4 map -dry-run {src}/ {dst}/ cat').splitlines())
+        assert lines == [[f'{src}/{i:05}', '->', f'{dst}/{i:05}'] for i in range(3)]
+        assert run(f's4 ls {dst}/', warn=True)['exitcode'] != 0
+        run(f's4 map-to-n {src}/ s4://bucket/shuf/ "cat > 000; echo 000"')
+        lines = run('s4 map-from-n -dry-run s4://bucket/shuf/ s4://bucket/merged/ "xargs cat"').splitlines()
+        assert [line.split()[1:] for line in lines] == [['group=000'] + [f's4://bucket/shuf/{i:05}/000' for i in range(3)] + ['->', 's4://bucket/merged/000']]
+
+def test_map_limits():
+    with servers():
+        src = 's4://bucket/data_in'
+        run(f's4 cp - {src}/00000', stdin='line\n')
+        res = run(f's4 map -keep-going -disk 1M {src}/ s4://bucket/disk/ "head -c 20000000 /dev/zero > big; sleep 5; cat"', warn=True)
+        assert res['exitcode'] != 0
+        assert 'killed: disk limit' in res['stderr']
+        run(f's4 map -memory 1G -pids 10000 -disk 1G {src}/ s4://bucket/ok/ cat')
+        assert run('s4 cp s4://bucket/ok/00000 -') == 'line'
+
+def test_map_env():
+    with servers(num_servers=1):
+        src = 's4://bucket/data_in'
+        run(f's4 cp - {src}/00000', stdin='line\n')
+        run(f's4 map -retries 1 -retry-backoff 10ms {src}/ s4://bucket/out/ "[ \\$S4_ATTEMPT = 2 ] && env | grep ^S4_ | grep -v ^S4_CONF | grep -v ^S4_JOB | sort"')
+        assert run('s4 cp s4://bucket/out/00000 -').splitlines() == [
+            'S4_ATTEMPT=2',
+            'S4_BUCKET=bucket',
+            'S4_KEY=s4://bucket/data_in/00000',
+            'S4_OUTKEY=s4://bucket/out/00000',
+            'S4_SERVER_COUNT=1',
+            'S4_SERVER_INDEX=0',
+        ]
+        run(f's4 map-to-n {src}/ s4://bucket/outn/ "echo \\$S4_OUTDIR > x; echo x"')
+        assert run('s4 cp s4://bucket/outn/00000/x -') == 's4://bucket/outn/00000/'
+        run('s4 map-from-n s4://bucket/outn/ s4://bucket/outm/ "echo \\$S4_GROUP \\$S4_NUM_INPUTS"')
+        assert run('s4 cp s4://bucket/outm/x -') == 'x 1'
+        assert run(f's4 eval {src}/00000 "echo \\$S4_KEY"') == f'{src}/00000'
+
+def test_map_sandbox():
+    with servers(extra_conf='-sandbox'):
+        src = 's4://bucket/data_in'
+        run(f's4 cp - {src}/00000', stdin='line\n')
+        run(f's4 cp - {src}/00001', stdin='other\n')
+        run(f's4 map {src}/*0 s4://bucket/out/ "bash -c \'cat; find / -name 0000? | wc -l; (echo > /dev/tcp/127.0.0.1/8080) 2>/dev/null || echo nonet\'"')
+        assert run('s4 cp s4://bucket/out/00000 -').splitlines() == ['line', '1', 'nonet']
+        assert run(f's4 eval {src}/00001 "cat; ls /proc | grep -c ^[0-9]"').splitlines() == ['other', '3']
+        assert run(f's4 eval {src}/00001 "grep CapEff /proc/self/status | cut -f2"') == '0000000000000000'
+        assert run(f's4 eval {src}/00001 "mkdir x && chroot x true 2>/dev/null || echo nochroot"') == 'nochroot'
+
 def test_map_glob():
     with servers(1_000_000):
         src = 's4://bucket/data_in'
@@ -478,6 +774,29 @@ def test_map_to_n_should_fail_quickly_on_bad_file_paths():
         with pytest.raises(Exception):
             run(f's4 map-to-n {step1}/ {step2}/ "cat >/dev/null && echo does_not_exist"')
 
+def test_map_from_n_partition_rule():
+    with servers(conf_lines='partition events -part([0-9]+)\\.csv$ numeric\n'):
+        for day in ['01', '02']:
+            for part in [7, 9]:
+                run(f's4 cp - s4://events/in/events-2024-01-{day}-part{part}.csv', stdin=f'{day} {part}\n')
+        run("s4 map-from-n s4://events/in/ s4://events/out/ 'xargs cat'")
+        assert run("s4 ls s4://events/out/ | awk '{print $NF}'").splitlines() == ['events-2024-01-01-part7.csv', 'events-2024-01-01-part9.csv']
+        assert run('s4 cp s4://events/out/events-2024-01-01-part9.csv -').splitlines() == ['01 9', '02 9']
+        for part in [7, 9]:
+            outkey = f's4://events/out/events-2024-01-01-part{part}.csv'
+            inkey = f's4://events/in/events-2024-01-02-part{part}.csv'
+            assert run(f"s4 where {outkey} | awk '{{print $NF}}'") == run(f"s4 where {inkey} | awk '{{print $NF}}'")
+
+def test_where_partitions_rule():
+    with servers(conf_lines='partition events ^([0-9]+)$\n'):
+        for bucket in ['bucket', 'events']:
+            lines = run(f's4 where -partitions 6 s4://{bucket}/out/').splitlines()
+            assert [line.split()[0] for line in lines] == ['000', '001', '002', '003', '004', '005']
+            for line in lines:
+                partition, server = line.split()
+                assert run(f"s4 where s4://{bucket}/out/{partition} | awk '{{print $NF}}'") == server
+        assert run('s4 where -partitions 6', warn=True)['exitcode'] != 0
+
 def test_map_from_n():
     # builds on map and map_to_n test
     with servers(1_000_000):
@@ -541,6 +860,120 @@ def test_map_from_n_without_numeric_prefixes():
                 result.append(word)
         assert sorted(result) == sorted(run('cat step4/00000', stream=False).splitlines())
 
+def test_map_to_n_partition_by():
+    with servers():
+        for i in range(4):
+            run(f's4 cp - s4://bucket/in/{i:05}', stdin=''.join(f'{j},{j % 7}\n' for j in range(i * 100, i * 100 + 100)))
+        run("s4 map-to-n -partition-by 'field:2,sep:,' -partitions 16 s4://bucket/in/ s4://bucket/out/")
+        run("s4 map-from-n s4://bucket/out/ s4://bucket/merged/ 'xargs cat | cut -d, -f2 | sort -u'")
+        values = [run(f's4 cp s4://bucket/merged/{key} -').splitlines() for key in run("s4 ls s4://bucket/merged/ | awk '{print $NF}'").splitlines()]
+        assert sorted(value for vals in values for value in vals) == [str(i) for i in range(7)]
+        run("s4 map-to-n -partition-by line -partitions 4 s4://bucket/in/ s4://bucket/lines/ 'grep ,0'")
+        run('s4 cp -r s4://bucket/lines/ lines/')
+        assert int(run('cat lines/*/* | wc -l')) == len([j for j in range(400) if j % 7 == 0])
+
+def test_map_to_n_stream():
+    with servers():
+        run('s4 cp - s4://bucket/in/00000', stdin='a\n')
+        cmd = "bash -c 'for i in 1 2 3; do seq \\$i > 0000\\$i; ls | wc -l >&2; echo 0000\\$i; sleep 1; done'"
+        res = run(f's4 map-to-n -logs -stream s4://bucket/in/ s4://bucket/out/ "{cmd}"', warn=True)
+        assert res['exitcode'] == 0
+        assert [line.split()[-1] for line in res['stderr'].splitlines()] == ['1', '1', '1']
+        assert run("s4 ls -r s4://bucket/out/ | awk '{print $NF}'").splitlines() == ['out/00000/00001', 'out/00000/00002', 'out/00000/00003']
+        assert run('s4 cp s4://bucket/out/00000/00003 -').splitlines() == ['1', '2', '3']
+        run('s4 cp - s4://bucket/in/00001', stdin='b\n')
+        cmd = "bash -c 'seq 1 > 00001; echo 00001; sleep 1; [ \\$filename = 00000 ]'"
+        res = run(f's4 map-to-n -keep-going -stream s4://bucket/in/ s4://bucket/out2/ "{cmd}"', warn=True)
+        assert res['exitcode'] != 0
+        assert run("s4 ls -r s4://bucket/out2/ | awk '{print $NF}'").splitlines() == ['out2/00000/00001']
+        cmd = cmd.replace('[ \\$filename = 00000 ]', 'true')
+        run(f's4 map-to-n -resume -stream s4://bucket/in/ s4://bucket/out2/ "{cmd}"')
+        assert run("s4 ls -r s4://bucket/out2/ | awk '{print $NF}'").splitlines() == ['out2/00000/00001', 'out2/00001/00001']
+
+def test_map_to_n_combine():
+    with servers():
+        for i in range(6):
+            run(f's4 cp - s4://bucket/in/{i:05}', stdin=f'a{i}\nb{i}\n')
+        run("s4 map-to-n -combine 'xargs cat | sort' s4://bucket/in/ s4://bucket/out/ 'while read l; do echo $l >> $(echo $l | cut -c1 | tr ab 01 | xargs printf %05d); done; ls 0*'")
+        keys = run("s4 ls -r s4://bucket/out/ | awk '{print $NF}'").splitlines()
+        assert len(keys) <= 6 and all(key.startswith('out/combine_') for key in keys)
+        assert sorted({key.split('/')[-1] for key in keys}) == ['00000', '00001']
+        run("s4 map-from-n s4://bucket/out/ s4://bucket/merged/ 'xargs cat | sort'")
+        assert run('s4 cp s4://bucket/merged/00000 -').splitlines() == [f'a{i}' for i in range(6)]
+        assert run('s4 cp s4://bucket/merged/00001 -').splitlines() == [f'b{i}' for i in range(6)]
+
+def test_join():
+    with servers():
+        for key in ['00000_x', '00001_x', '00001_y']:
+            run(f's4 cp - s4://bucket/a/{key}', stdin=f'a{key}\n')
+        for key in ['00001_x', '00002_x']:
+            run(f's4 cp - s4://bucket/b/{key}', stdin=f'b{key}\n')
+        cmd = "'echo $(xargs cat < $S4_LEFT) / $(xargs -r cat < $S4_RIGHT)'"
+        run(f's4 join s4://bucket/a/ s4://bucket/b/ s4://bucket/inner/ {cmd}')
+        assert run("s4 ls s4://bucket/inner/ | awk '{print $NF}'").splitlines() == ['00001']
+        assert run('s4 cp s4://bucket/inner/00001 -') == 'a00001_x a00001_y / b00001_x'
+        run(f's4 join -how left s4://bucket/a/ s4://bucket/b/ s4://bucket/left/ {cmd}')
+        assert run("s4 ls s4://bucket/left/ | awk '{print $NF}'").splitlines() == ['00000_x', '00001']
+        assert run('s4 cp s4://bucket/left/00000_x -') == 'a00000_x /'
+        run(f's4 join -how outer s4://bucket/a/ s4://bucket/b/ s4://bucket/outer/ {cmd}')
+        assert run("s4 ls s4://bucket/outer/ | awk '{print $NF}'").splitlines() == ['00000_x', '00001', '00002_x']
+        assert run('s4 cp s4://bucket/outer/00002_x -') == '/ b00002_x'
+
+def test_run_pipeline():
+    with servers():
+        for i in range(3):
+            run(f's4 cp - s4://bucket/in/{i:05}', stdin=f'a{i}\nb{i}\n')
+        stages = [
+            {'name': 'count', 'kind': 'eval', 'key': 's4://bucket/merged/00000', 'cmd': 'wc -l; exit 1'},
+            {'name': 'merge', 'kind': 'map_from_n', 'indir': 's4://bucket/parts/', 'outdir': 's4://bucket/merged/', 'cmd': 'xargs cat', 'keep': True},
+            {'name': 'upper', 'kind': 'map', 'indir': 's4://bucket/in/', 'outdir': 's4://bucket/upper/', 'cmd': 'tr a-z A-Z'},
+            {'name': 'parts', 'kind': 'map_to_n', 'indir': 's4://bucket/upper/', 'outdir': 's4://bucket/parts/', 'cmd': '', 'partition_by': 'line', 'partitions': 1},
+        ]
+        with open('pipeline.json', 'w') as f:
+            json.dump({'stages': stages}, f)
+        res = run('s4 run pipeline.json', warn=True)
+        assert res['exitcode'] != 0
+        assert 'stage count failed' in res['stderr']
+        stages[0]['cmd'] = 'wc -l'
+        with open('pipeline.json', 'w') as f:
+            json.dump({'stages': stages}, f)
+        res = run('s4 run pipeline.json', warn=True)
+        assert res['exitcode'] == 0
+        assert res['stdout'] == '6'
+        assert [line for line in res['stderr'].splitlines() if 'skipped' in line] == ['stage upper skipped', 'stage parts skipped', 'stage merge skipped']
+        assert run("s4 ls -r s4://bucket/ | awk '{print $NF}'").splitlines() == ['in/00000', 'in/00001', 'in/00002', 'merged/00000']
+        assert not os.path.exists('pipeline.json.state')
+
+def test_run_pipeline_restart():
+    with servers():
+        for i in range(3):
+            run(f's4 cp - s4://bucket/in/{i:05}', stdin=f'line {i}\n')
+        flag = os.path.abspath('flag')
+        stages = [
+            {'name': 'upper', 'kind': 'map', 'indir': 's4://bucket/in/', 'outdir': 's4://bucket/upper/', 'keep_going': True, 'keep': True,
+             'cmd': f'bash -c "tr a-z A-Z; [ $filename != 00001 ] || [ -f {flag} ]"'},
+            {'name': 'show', 'kind': 'eval', 'key': 's4://bucket/upper/00001', 'cmd': 'cat; exit 1'},
+        ]
+        with open('pipeline.json', 'w') as f:
+            json.dump({'stages': stages}, f)
+        res = run('s4 run pipeline.json', warn=True)
+        assert res['exitcode'] != 0
+        assert 'stage upper failed' in res['stderr']
+        run(f'touch {flag}')
+        res = run('s4 run pipeline.json', warn=True)
+        assert res['exitcode'] != 0
+        assert 'stage upper done' in res['stderr']
+        assert 'stage show failed' in res['stderr']
+        stages[0]['cmd'] = 'bash -c "tr a-z A-Z | rev"'
+        stages[1]['cmd'] = 'cat'
+        with open('pipeline.json', 'w') as f:
+            json.dump({'stages': stages}, f)
+        res = run('s4 run pipeline.json', warn=True)
+        assert res['exitcode'] == 0
+        assert res['stdout'] == '1 ENIL'
+        assert run('s4 cp s4://bucket/upper/00000 -') == '0 ENIL'
+        assert not os.path.exists('pipeline.json.state')
+
 def test_map_should_work_on_the_output_of_map_to_n():
     with servers(1_000_000):
         step1 = 's4://bucket/step1' # input data